@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+var errInterrupt = errors.New("interrupt")
+
+// An editor reads lines of input.
+//
+// If the input is a terminal, the editor supports moving the cursor with the
+// arrow keys, Ctrl-A, and Ctrl-E, deleting with Backspace, Delete, Ctrl-U, and
+// Ctrl-K, and recalling history with the up and down arrow keys. Otherwise, it
+// reads lines as they are.
+//
+// If cmp is set, pressing Tab completes the word before the cursor. Given the
+// text before the cursor, cmp returns the part of the word that has already
+// been typed and the words that complete it.
+//
+// Pasted text is inserted as it is, so that tabs do not complete words. If it
+// has multiple lines, they are read in turn, as if they were typed.
+type editor struct {
+	in  *os.File
+	out io.Writer
+	rd  *bufio.Reader
+	his *history
+	cmp func(head string) (string, []string)
+	buf []rune   // Line being edited.
+	pos int      // Cursor position in buf.
+	pen []string // Pasted lines that have not been read.
+	pre []rune   // Pasted text after the last pasted line.
+}
+
+func newEditor(in *os.File, out io.Writer, his *history) *editor {
+	return &editor{in: in, out: out, rd: bufio.NewReader(in), his: his}
+}
+
+// readLine prints prompt and reads a line of input, including the trailing
+// newline. At the end of input, it returns any partial line and io.EOF.
+// If the user presses Ctrl-C, it returns errInterrupt.
+//
+// If the input is not a terminal, no prompt is printed, so that the output of
+// a script is not interleaved with prompts.
+func (e *editor) readLine(prompt string) (string, error) {
+	fd := int(e.in.Fd())
+	if !term.IsTerminal(fd) {
+		return e.rd.ReadString('\n')
+	}
+	fmt.Fprint(e.out, prompt)
+	if len(e.pen) > 0 {
+		line := e.pen[0]
+		e.pen = e.pen[1:]
+		fmt.Fprint(e.out, line+"\r\n")
+		return line + "\n", nil
+	}
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return e.readString()
+	}
+	// Bracketed paste marks pasted text with escape sequences.
+	fmt.Fprint(e.out, "\x1b[?2004h")
+	defer func() {
+		fmt.Fprint(e.out, "\x1b[?2004l")
+		_ = term.Restore(fd, state)
+	}()
+	e.buf, e.pos = append(e.buf[:0], e.pre...), len(e.pre)
+	e.pre = nil
+	if e.pos > 0 {
+		e.render(prompt)
+	}
+	var lns []string
+	if e.his != nil {
+		lns = e.his.lns
+	}
+	idx, cur := len(lns), ""
+	recall := func(i int) {
+		if i < 0 || i > len(lns) {
+			return
+		}
+		if idx == len(lns) {
+			cur = string(e.buf)
+		}
+		idx = i
+		if idx == len(lns) {
+			e.buf = []rune(cur)
+		} else {
+			e.buf = []rune(lns[idx])
+		}
+		e.pos = len(e.buf)
+	}
+	for {
+		r, _, err := e.rd.ReadRune()
+		if err != nil {
+			fmt.Fprint(e.out, "\r\n")
+			return string(e.buf), err
+		}
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(e.out, "\r\n")
+			return string(e.buf) + "\n", nil
+		case 1: // Ctrl-A
+			e.pos = 0
+		case 3: // Ctrl-C
+			fmt.Fprint(e.out, "^C\r\n")
+			return "", errInterrupt
+		case 4: // Ctrl-D
+			if len(e.buf) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+			e.delete(e.pos, e.pos+1)
+		case 5: // Ctrl-E
+			e.pos = len(e.buf)
+		case 8, 127: // Backspace
+			e.delete(e.pos-1, e.pos)
+		case '\t':
+			e.complete()
+		case 11: // Ctrl-K
+			e.delete(e.pos, len(e.buf))
+		case 21: // Ctrl-U
+			e.delete(0, e.pos)
+		case 27: // Escape sequence
+			switch e.escape() {
+			case "[A", "OA":
+				recall(idx - 1)
+			case "[B", "OB":
+				recall(idx + 1)
+			case "[C", "OC":
+				e.pos = min(e.pos+1, len(e.buf))
+			case "[D", "OD":
+				e.pos = max(e.pos-1, 0)
+			case "[H", "OH", "[1~", "[7~":
+				e.pos = 0
+			case "[F", "OF", "[4~", "[8~":
+				e.pos = len(e.buf)
+			case "[3~":
+				e.delete(e.pos, e.pos+1)
+			case "[200~":
+				lines := strings.Split(e.paste(), "\n")
+				ins := []rune(lines[0])
+				e.buf = slices.Insert(e.buf, e.pos, ins...)
+				e.pos += len(ins)
+				if len(lines) > 1 {
+					e.pen = lines[1 : len(lines)-1]
+					e.pre = []rune(lines[len(lines)-1])
+					e.render(prompt)
+					fmt.Fprint(e.out, "\r\n")
+					return string(e.buf) + "\n", nil
+				}
+			}
+		default:
+			if r < ' ' {
+				continue
+			}
+			e.buf = slices.Insert(e.buf, e.pos, r)
+			e.pos++
+		}
+		e.render(prompt)
+	}
+}
+
+// complete completes the word before the cursor. If there are multiple
+// completions, it completes their common prefix, or lists them if there is
+// no common prefix to add.
+func (e *editor) complete() {
+	if e.cmp == nil {
+		return
+	}
+	part, cands := e.cmp(string(e.buf[:e.pos]))
+	if len(cands) == 0 {
+		return
+	}
+	pre := cands[0]
+	for _, c := range cands[1:] {
+		for !strings.HasPrefix(c, pre) {
+			pre = pre[:len(pre)-1]
+		}
+	}
+	if len(pre) > len(part) {
+		ins := []rune(pre[len(part):])
+		e.buf = slices.Insert(e.buf, e.pos, ins...)
+		e.pos += len(ins)
+	} else if len(cands) > 1 {
+		fmt.Fprintf(e.out, "\r\n%s\r\n", strings.Join(cands, "  "))
+	}
+}
+
+// readString reads a line of input as it is.
+func (e *editor) readString() (string, error) {
+	line, err := e.rd.ReadString('\n')
+	if errors.Is(err, io.EOF) && line == "" {
+		fmt.Fprintln(e.out)
+	}
+	return line, err
+}
+
+// escape reads the rest of an escape sequence.
+func (e *editor) escape() string {
+	var seq strings.Builder
+	for {
+		r, _, err := e.rd.ReadRune()
+		if err != nil {
+			return seq.String()
+		}
+		seq.WriteRune(r)
+		if seq.Len() > 1 && (r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' ||
+			r == '~') {
+			return seq.String()
+		}
+	}
+}
+
+// paste reads pasted text up to the end of bracketed paste, with newlines
+// in place of carriage returns.
+func (e *editor) paste() string {
+	var text strings.Builder
+	for {
+		r, _, err := e.rd.ReadRune()
+		if err != nil {
+			break
+		}
+		text.WriteRune(r)
+		if strings.HasSuffix(text.String(), "\x1b[201~") {
+			break
+		}
+	}
+	s := strings.TrimSuffix(text.String(), "\x1b[201~")
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	return strings.ReplaceAll(s, "\r", "\n")
+}
+
+// delete removes buf[i:j], clamped to the bounds of buf.
+func (e *editor) delete(i, j int) {
+	i, j = max(i, 0), min(j, len(e.buf))
+	if i >= j {
+		return
+	}
+	e.buf = append(e.buf[:i], e.buf[j:]...)
+	if e.pos > j {
+		e.pos -= j - i
+	} else if e.pos > i {
+		e.pos = i
+	}
+}
+
+// render redraws the line being edited.
+func (e *editor) render(prompt string) {
+	fmt.Fprintf(e.out, "\r%s%s\x1b[K", prompt, string(e.buf))
+	if n := len(e.buf) - e.pos; n > 0 {
+		fmt.Fprintf(e.out, "\x1b[%dD", n)
+	}
+}
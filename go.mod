@@ -1,14 +1,16 @@
 module lesiw.io/igo
 
-go 1.24.0
+go 1.25.0
 
 require (
 	github.com/google/shlex v0.0.0-20191202100458-e7afc7fbc510
-	golang.org/x/tools v0.42.0
+	golang.org/x/term v0.40.0
+	golang.org/x/tools v0.44.0
 	lesiw.io/defers v0.9.0
 )
 
 require (
-	golang.org/x/mod v0.33.0 // indirect
-	golang.org/x/sync v0.19.0 // indirect
+	golang.org/x/mod v0.35.0 // indirect
+	golang.org/x/sync v0.20.0 // indirect
+	golang.org/x/sys v0.43.0 // indirect
 )
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A history is a list of input lines persisted to a file.
+type history struct {
+	pth string   // Path to history file.
+	ctl []string // Filters from IGO_HISTCONTROL.
+	lns []string // Lines, oldest first.
+}
+
+// loadHistory reads the history file.
+//
+// The file is located at $IGO_HISTFILE, $XDG_STATE_HOME/igo/history, or
+// ~/.igo_history, in that order of preference.
+func loadHistory() (*history, error) {
+	h := new(history)
+	if ctl := os.Getenv("IGO_HISTCONTROL"); ctl != "" {
+		h.ctl = strings.Split(ctl, ":")
+	}
+	if h.pth = os.Getenv("IGO_HISTFILE"); h.pth == "" {
+		if state := os.Getenv("XDG_STATE_HOME"); state != "" {
+			h.pth = filepath.Join(state, "igo", "history")
+		} else if home, err := os.UserHomeDir(); err == nil {
+			h.pth = filepath.Join(home, ".igo_history")
+		} else {
+			return h, fmt.Errorf("failed to find history file: %w", err)
+		}
+	}
+	f, err := os.Open(h.pth)
+	if errors.Is(err, fs.ErrNotExist) {
+		return h, nil
+	} else if err != nil {
+		return h, fmt.Errorf("failed to read history: %w", err)
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		h.lns = append(h.lns, sc.Text())
+	}
+	if err := sc.Err(); err != nil {
+		return h, fmt.Errorf("failed to read history: %w", err)
+	}
+	return h, nil
+}
+
+// add appends line to the history, unless it is empty or filtered out by
+// IGO_HISTCONTROL. If the history file cannot be written, it stops being
+// written to for the rest of the session.
+//
+// IGO_HISTCONTROL is a colon-separated list of filters. The ignoremeta filter
+// skips lines starting with "." and the ignoreshell filter skips lines
+// starting with ":".
+func (h *history) add(line string) error {
+	if line == "" || h.pth == "" {
+		return nil
+	}
+	for _, ctl := range h.ctl {
+		switch {
+		case ctl == "ignoremeta" && strings.HasPrefix(line, "."):
+			return nil
+		case ctl == "ignoreshell" && strings.HasPrefix(line, ":"):
+			return nil
+		}
+	}
+	h.lns = append(h.lns, line)
+	if err := h.write(line); err != nil {
+		h.pth = ""
+		return err
+	}
+	return nil
+}
+
+func (h *history) write(line string) error {
+	if err := os.MkdirAll(filepath.Dir(h.pth), 0700); err != nil {
+		return fmt.Errorf("failed to write history: %w", err)
+	}
+	f, err := os.OpenFile(h.pth, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write history: %w", err)
+	}
+	if _, err := fmt.Fprintln(f, line); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to write history: %w", err)
+	}
+	return f.Close()
+}
@@ -1,253 +1,488 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"errors"
+	"flag"
 	"fmt"
-	"go/ast"
-	"go/format"
-	"go/parser"
-	"go/token"
+	"io"
+	"io/fs"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"regexp"
+	"runtime/debug"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/shlex"
-	"golang.org/x/tools/imports"
-
+	"golang.org/x/term"
 	"lesiw.io/defers"
+	"lesiw.io/igo/repl"
 )
 
-var builderr = regexp.MustCompile(`^(\./[^\s:]+):(\d+):(\d+):\s*(.+)$`)
-var errEOF = errors.New("bad EOF")
+const usage = `usage: igo [-fail-fast] [-get] [-keep] [-race] [-stateful]
+           [-strict] [-timeout DURATION] [-tags TAG,...]
+           [-goflags FLAGS] [-norc | -rc FILE] [-i PKG,...]...
+           [-stdin FILE] [-transcript FILE] [-no-color]
+           [-no-pager] [-deterministic] [-dir DIR] [-e CODE]...
+           [-module DIR] [-cache-dir DIR] [-listen ADDR]
+           [-kernel FILE] [-sandbox] [-go COMMAND]
+           [-go-version VERSION] [-version] [FILE]
+`
+
+// stdout and stderr are the output of igo, which the transcript also receives,
+// along with the prompts and input of the terminal.
+var (
+	stdout     io.Writer = os.Stdout
+	stderr     io.Writer = os.Stderr
+	transcript io.Writer = io.Discard
+)
 
-const unused = "declared and not used: "
-const foundEOF = "found 'EOF'"
+// terminal is the terminal that stdout prints to, if it is not os.Stdout.
+var terminal *os.File
 
-type session struct {
-	dir string       // Working directory.
-	pth string       // Path to source file.
-	src []byte       // Source code.
-	off int          // Offset to the last bracket of main().
-	frm int          // Last printed line.
-	usr bytes.Buffer // User code.
-	rem string       // Remaining output after EOF.
-}
+// color is set if output is printed in color, with ANSI escape codes.
+var color bool
+
+// ANSI escape codes of the colors of the prompt and of errors.
+const (
+	promptColor = "1;34"
+	errorColor  = "31"
+)
 
 func main() {
 	defer defers.Run()
 	if err := run(); err != nil {
-		fmt.Fprintln(os.Stderr, err)
+		if code := exitCode(0); errors.As(err, &code) {
+			defers.Exit(int(code))
+		}
+		printError(err)
+		if ee := new(exec.ExitError); errors.As(err, &ee) {
+			defers.Exit(ee.ExitCode())
+		}
 		defers.Exit(1)
 	}
 }
 
 func run() error {
-	var s session
-	var err error
-	if len(os.Args) < 2 {
-		dir, err := os.MkdirTemp("", "igo")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	stateful := flag.Bool("stateful", false,
+		"restore variables instead of rerunning code")
+	timeout := flag.Duration("timeout", 30*time.Second,
+		"time limit for running each line, or 0 for none")
+	get := flag.Bool("get", false, "run go get for missing modules")
+	failFast := flag.Bool("fail-fast", false,
+		"exit at the first error if input is not a terminal")
+	strict := flag.Bool("strict", false,
+		"report unused variables instead of using them")
+	race := flag.Bool("race", false, "build with the race detector")
+	tags := flag.String("tags", "", "comma-separated build `tags`")
+	goflags := flag.String("goflags", "", "additional `flags` for go build")
+	keep := flag.Bool("keep", false,
+		"keep the temporary module and print its path")
+	norc := flag.Bool("norc", false, "do not run the init file")
+	rc := flag.String("rc", "", "run `file` as the init file")
+	script := flag.String("transcript", "",
+		"record prompts, input, and output to `file`")
+	noColor := flag.Bool("no-color", false, "do not print in color")
+	deterministic := flag.Bool("deterministic", false,
+		"seed math/rand and freeze time.Now, so that runs repeat")
+	dir := flag.String("dir", "",
+		"run programs and shell commands in `directory`")
+	module := flag.String("module", "",
+		"import the packages of the module in `directory`")
+	cacheDir := flag.String("cache-dir", "",
+		"build in the module in `dir`, which persists, not a temporary one")
+	goCmd := flag.String("go", os.Getenv("IGO_GO"),
+		"use the go `command`, e.g. a path to a go binary; defaults to $IGO_GO")
+	goVersion := flag.String("go-version", "",
+		"declare the go `version` in the go.mod of the temporary module")
+	noPager := flag.Bool("no-pager", false,
+		"do not page long output through $PAGER")
+	stdin := flag.String("stdin", "",
+		"read `file` as the standard input of every run")
+	listen := flag.String("listen", "",
+		"serve sessions over TCP on `address`, e.g. :4000 for localhost")
+	jupyter := flag.String("kernel", "",
+		"run as a Jupyter kernel with the connection `file`")
+	sandbox := flag.Bool("sandbox", false,
+		"run programs as WebAssembly with wasmtime or wazero")
+	showVersion := flag.Bool("version", false,
+		"print the versions of igo and go and exit")
+	var pkgs []string
+	flag.Func("i", "import comma-separated `packages`; may be repeated",
+		func(list string) error {
+			for pkg := range strings.SplitSeq(list, ",") {
+				if pkg = strings.TrimSpace(pkg); pkg != "" {
+					pkgs = append(pkgs, strconv.Quote(pkg))
+				}
+			}
+			return nil
+		})
+	var exprs []string
+	flag.Func("e", "evaluate `code` and exit; may be repeated",
+		func(code string) error {
+			exprs = append(exprs, code)
+			return nil
+		})
+	flag.Parse()
+	if *goCmd != "" {
+		if err := useGo(*goCmd); err != nil {
+			return err
+		}
+	}
+	if *showVersion {
+		fmt.Println(version())
+		return nil
+	}
+	flags, err := shlex.Split(*goflags)
+	if err != nil {
+		return fmt.Errorf("bad -goflags: %w", err)
+	}
+	if *tags != "" {
+		flags = append(flags, "-tags="+*tags)
+	}
+	if *script != "" {
+		f, err := os.Create(*script)
 		if err != nil {
-			return fmt.Errorf("failed to create temporary directory: %w", err)
-		}
-		defers.Add(func() { _ = os.RemoveAll(dir) })
-		cmd := exec.Command("go", "mod", "init", "igo.localhost")
-		cmd.Dir = dir
-		if out, err := cmd.CombinedOutput(); err != nil {
-			return fmt.Errorf(`failed to run "go mod init": %s`,
-				bytes.TrimSpace(out))
-		}
-		s.pth = filepath.Join(dir, "main.go")
-		s.src = []byte("package main\n\nfunc main() {}\n")
-		s.off = len(s.src) - 2
-		s.dir = dir
-	} else {
-		s.pth = os.Args[1]
-		s.src, err = os.ReadFile(s.pth)
+			return fmt.Errorf("failed to create transcript: %w", err)
+		}
+		defer f.Close()
+		transcript = plain{f}
+		stdout = io.MultiWriter(os.Stdout, transcript)
+		terminal = os.Stdout
+		stderr = io.MultiWriter(os.Stderr, transcript)
+	}
+	var in io.Reader
+	if *stdin != "" {
+		f, err := os.Open(*stdin)
 		if err != nil {
-			return fmt.Errorf("bad file %q: %w", s.pth, err)
+			return fmt.Errorf("failed to open stdin: %w", err)
+		}
+		defer f.Close()
+		in = f
+	}
+	tty := term.IsTerminal(int(os.Stdin.Fd()))
+	color = !*noColor && os.Getenv("NO_COLOR") == "" &&
+		term.IsTerminal(int(os.Stdout.Fd()))
+	ed := newEditor(os.Stdin, os.Stdout, nil)
+	var choose func(name string, paths []string) string
+	if tty {
+		choose = func(name string, paths []string) string {
+			return chooseImport(ed, name, paths)
+		}
+	}
+	var progress io.Writer
+	if tty && term.IsTerminal(int(os.Stdout.Fd())) {
+		progress = os.Stdout
+	}
+	opts := repl.Options{
+		File:          flag.Arg(0),
+		Dir:           *dir,
+		Module:        *module,
+		CacheDir:      *cacheDir,
+		GoVersion:     *goVersion,
+		Stateful:      *stateful,
+		Timeout:       *timeout,
+		Get:           *get,
+		Strict:        *strict,
+		Race:          *race,
+		BuildFlags:    flags,
+		Keep:          *keep,
+		Stdin:         in,
+		Stdout:        stdout,
+		Stderr:        stderr,
+		Terminal:      terminal,
+		Transcript:    transcript,
+		Choose:        choose,
+		Color:         color,
+		NoPager:       *noPager,
+		Deterministic: *deterministic,
+		Progress:      progress,
+		Sandbox:       *sandbox,
+	}
+	var imp string
+	if len(pkgs) > 0 {
+		// Typed imports are kept even while they are not used.
+		imp = "import (\n" + strings.Join(pkgs, "\n") + "\n)"
+	}
+	if *jupyter != "" {
+		opts.Choose, opts.Color, opts.NoPager = nil, false, true
+		opts.Progress = nil
+		return runKernel(*jupyter, opts, imp)
+	}
+	if *listen != "" {
+		if flag.NArg() > 0 {
+			return errors.New("-listen cannot be used with a FILE")
 		}
-		src := []byte(s.src)
-		defers.Add(func() { _ = os.WriteFile(s.pth, src, 0644) })
-		if err := s.prepareSrc(); err != nil {
+		if *cacheDir != "" {
+			return errors.New("-listen cannot be used with -cache-dir")
+		}
+		opts.Stdout, opts.Stderr, opts.Choose = nil, nil, nil
+		opts.Progress = nil
+		opts.Color, opts.NoPager = false, true
+		return serve(*listen, opts, imp)
+	}
+	s, err := repl.NewSession(opts)
+	if err != nil {
+		return err
+	}
+	if *keep && flag.NArg() < 1 {
+		fmt.Fprintln(stderr, s.Dir())
+	}
+	defers.Add(func() { _ = s.Close() })
+	// Interrupt the program being run, rather than exiting.
+	signal.Reset(os.Interrupt)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	defer signal.Stop(sig)
+	go func() {
+		for range sig {
+			s.Interrupt()
+		}
+	}()
+	if imp != "" {
+		if _, err := s.Eval(imp); err != nil {
 			return err
 		}
 	}
-	return s.run()
+	if !*norc {
+		if err := runInit(s, *rc); err != nil {
+			printError(err)
+		}
+	}
+	if len(exprs) > 0 {
+		return evalAll(s, exprs)
+	}
+	if ed.his, err = loadHistory(); err != nil {
+		printError(err)
+	}
+	if tty {
+		fmt.Fprintln(stdout, version())
+	}
+	if err := loop(s, ed, *failFast && !tty); err != nil {
+		return err
+	}
+	if code := s.ExitCode(); !tty && code != 0 {
+		// Scripts exit with the status of the program that ran last.
+		return exitCode(code)
+	}
+	return nil
+}
+
+// An exitCode is the status that igo exits with, without printing an error.
+type exitCode int
+
+func (c exitCode) Error() string {
+	return fmt.Sprintf("exit status %d", int(c))
+}
+
+// version returns the version of igo and the output of go version, which is the
+// toolchain that runs the session, followed by the path of the go command.
+func version() string {
+	pth, err := exec.LookPath("go")
+	if err != nil {
+		return "igo " + igoVersion() + ", go not found"
+	}
+	out, err := exec.Command(pth, "version").Output()
+	if err != nil {
+		return "igo " + igoVersion() + ", go not found"
+	}
+	return fmt.Sprintf("igo %s, %s (%s)", igoVersion(),
+		strings.TrimSpace(string(out)), pth)
 }
 
-func (s *session) prepareSrc() error {
-	fs := token.NewFileSet()
-	root, err := parser.ParseFile(fs, filepath.Base(s.pth), s.src,
-		parser.AllErrors)
+// useGo makes the go command in $PATH, which igo, goimports, and go/packages
+// run, that of the toolchain of cmd, e.g. a path to a go binary or a wrapper
+// such as go1.22.0.
+func useGo(cmd string) error {
+	out, err := exec.Command(cmd, "env", "GOROOT").Output()
 	if err != nil {
-		return fmt.Errorf("failed to parse: %d", err)
-	}
-	if root.Name.Name != "main" {
-		// Set to package main.
-		root.Name.Name = "main"
-		var buf bytes.Buffer
-		if err := format.Node(&buf, fs, root); err != nil {
-			return fmt.Errorf("failed to modify source: %w", err)
-		}
-		s.src = buf.Bytes()
-	}
-	var found bool
-	ast.Inspect(root, func(n ast.Node) bool {
-		fn, ok := n.(*ast.FuncDecl)
-		if !ok || fn.Name.Name != "main" {
-			return true
-		}
-		found = true
-		s.off = fs.Position(fn.Body.Rbrace).Offset - 1
-		return true
-	})
-	if !found {
-		s.src = append(s.src, []byte("\n\nfunc main() {}\n")...)
-		s.off = len(s.src) - 2
+		return fmt.Errorf("bad go command %q: %w", cmd, err)
+	}
+	bin := filepath.Join(strings.TrimSpace(string(out)), "bin")
+	path := bin + string(os.PathListSeparator) + os.Getenv("PATH")
+	if err := os.Setenv("PATH", path); err != nil {
+		return fmt.Errorf("failed to set PATH: %w", err)
 	}
 	return nil
 }
 
-func (s *session) run() error {
-	r := bufio.NewReader(os.Stdin)
+// igoVersion returns the version of the igo module.
+func igoVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
+
+// chooseImport asks which of paths to import for the package name, and returns
+// "" for the first.
+func chooseImport(ed *editor, name string, paths []string) string {
+	fmt.Fprintf(stdout, "%s could be:\n", name)
+	for i, pth := range paths {
+		fmt.Fprintf(stdout, "%4d  %s\n", i+1, pth)
+	}
 	for {
-		fmt.Print("> ")
-		var line string
-	read:
-		input, err := r.ReadString('\n')
-		if err != nil {
-			return fmt.Errorf("failed to read input: %w", err)
-		}
+		prompt := fmt.Sprintf("import [1-%d]: ", len(paths))
+		input, err := ed.readLine(prompt)
+		record(prompt, input, err)
 		input = strings.TrimSpace(input)
-		if input == ".quit" || input == ".exit" {
-			fmt.Print(s.rem)
-			break
+		if err != nil || input == "" {
+			return ""
 		}
-		if strings.HasPrefix(input, ":") {
-			argv, err := shlex.Split(input[1:])
-			if err != nil || len(argv) == 0 {
-				fmt.Fprintf(os.Stderr, "bad command: %s", err)
-				continue
-			}
-			cmd := exec.Command(argv[0], argv[1:]...)
-			cmd.Dir = s.dir
-			if out, err := cmd.CombinedOutput(); err != nil {
-				fmt.Fprintf(os.Stderr, "command failed: ")
-				if ee := new(exec.ExitError); errors.As(err, &ee) {
-					fmt.Fprintf(os.Stderr, "%s\n",
-						bytes.TrimSuffix(out, []byte("\n")))
-				} else {
-					fmt.Fprintf(os.Stderr, "%s\n", err)
-				}
-			}
-		} else {
-			line += input
-			if err := s.exec(line); errors.Is(err, errEOF) {
-				goto read
-			} else if err != nil {
-				fmt.Fprintln(os.Stderr, err)
-			}
+		if n, err := strconv.Atoi(input); err == nil && n > 0 &&
+			n <= len(paths) {
+			return paths[n-1]
 		}
 	}
-	return nil
 }
 
-func (s *session) exec(input string) error {
-	var fixes strings.Builder
-	input = input + "\n"
-rerun:
-	if err := s.write(input + fixes.String()); err != nil {
-		return fmt.Errorf("failed to write file: %w", err)
+// runInit runs the lines of the init file at pth as if they were typed. If pth
+// is empty, the init file is $XDG_CONFIG_HOME/igo/init.go, or ~/.igorc.go if
+// $XDG_CONFIG_HOME is not set, and it is skipped if it does not exist.
+func runInit(s *repl.Session, pth string) error {
+	var optional bool
+	if pth == "" {
+		optional = true
+		if cfg := os.Getenv("XDG_CONFIG_HOME"); cfg != "" {
+			pth = filepath.Join(cfg, "igo", "init.go")
+		} else if home, err := os.UserHomeDir(); err == nil {
+			pth = filepath.Join(home, ".igorc.go")
+		} else {
+			return fmt.Errorf("failed to find init file: %w", err)
+		}
 	}
-	buf, err := imports.Process(s.pth, nil, nil)
-	if err != nil && strings.Contains(err.Error(), foundEOF) {
-		return errEOF
+	f, err := os.Open(pth)
+	if optional && errors.Is(err, fs.ErrNotExist) {
+		return nil
 	} else if err != nil {
-		return fmt.Errorf("failed to process imports: %w", err)
+		return fmt.Errorf("failed to read init file: %w", err)
 	}
-	if err := os.WriteFile(s.pth, buf, 0644); err != nil {
-		return fmt.Errorf("failed to write file: %w", err)
-	}
-	cmd := exec.Command("go", "run", s.pth)
-	cmd.Dir = s.dir
-	buf, err = cmd.CombinedOutput()
-	output := string(buf)
-	if err != nil {
-		lines := strings.Split(strings.TrimSuffix(output, "\n"), "\n")
-		if strings.HasPrefix(lines[len(lines)-1], "exit status ") {
-			// The program errored, so return its error.
-			return errors.New(strings.TrimSuffix(s.newLines(output), "\n"))
-		}
-		// This is a compile error, so try to fix it.
-		var fixed bool
-		for line := range strings.SplitSeq(output, "\n") {
-			if m := builderr.FindStringSubmatch(line); m != nil {
-				if strings.HasPrefix(m[4], unused) {
-					fixed = true
-					fixes.WriteString("_ = " + m[4][len(unused):] + "\n")
-				}
+	defer f.Close()
+	return loop(s, newEditor(f, os.Stdout, new(history)), false)
+}
+
+// evalAll evaluates each of inputs in turn, as if they were typed, and stops at
+// the first one that fails.
+func evalAll(s *repl.Session, inputs []string) error {
+	for _, input := range inputs {
+		input = strings.TrimSpace(input)
+		if ok, err := s.Command(input); ok {
+			if err != nil {
+				return err
 			}
+			continue
 		}
-		if fixed {
-			goto rerun
+		out, err := s.Eval(input)
+		fmt.Fprint(stdout, out)
+		if err != nil {
+			return err
 		}
-		return errors.New(strings.TrimSuffix(output, "\n"))
 	}
-	s.usr.WriteString(input)
-	out := strings.TrimSuffix(s.newLines(output), "\n")
-	if out != "" {
-		fmt.Println(out)
-	}
-	s.frm += strings.Count(s.newLines(output), "\n")
 	return nil
 }
 
-func (s *session) write(input string) (err error) {
-	f, err := os.Create(s.pth)
-	if err != nil {
-		return err
+// paint returns text in the color of the ANSI escape code, if color is set.
+func paint(code, text string) string {
+	if !color {
+		return text
 	}
-	defer f.Close()
-	w := func(b []byte) {
-		if err != nil {
-			return
-		}
-		_, err = f.Write(b)
+	return "\x1b[" + code + "m" + text + "\x1b[0m"
+}
+
+// printError prints err to stderr, in red if color is set.
+func printError(err error) {
+	fmt.Fprintln(stderr, paint(errorColor, err.Error()))
+}
+
+// ansi matches ANSI escape codes that set colors.
+var ansi = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
+// A plain writer writes to w without ANSI escape codes that set colors.
+type plain struct{ w io.Writer }
+
+func (p plain) Write(b []byte) (int, error) {
+	if _, err := p.w.Write(ansi.ReplaceAll(b, nil)); err != nil {
+		return 0, err
 	}
-	w(s.src[:s.off])
-	w([]byte("\n"))
-	w(s.usr.Bytes())
-	w([]byte(input))
-	w([]byte(`println("\000igo:EOF")`))
-	w(s.src[s.off:])
-	return
+	return len(b), nil
 }
 
-func (s *session) newLines(output string) string {
-	start := len(output)
-	var count int
-	for i, r := range output {
-		if count >= s.frm {
-			start = i
+// record writes prompt and the line of input read after it to the transcript,
+// as they appeared in the terminal.
+func record(prompt, input string, err error) {
+	if errors.Is(err, errInterrupt) {
+		input = "^C"
+	}
+	fmt.Fprintln(transcript, prompt+strings.TrimRight(input, "\r\n"))
+}
+
+// loop reads and evaluates input from ed until the end of input or .quit, and
+// adds it to the history of ed. If failFast is set, it stops at the first
+// input that fails and returns its error.
+func loop(s *repl.Session, ed *editor, failFast bool) error {
+	his := ed.his
+	ed.cmp = s.Complete
+	tty := term.IsTerminal(int(ed.in.Fd()))
+	var eof bool
+	for !eof {
+		prompt := paint(promptColor, "> ")
+		var line string // Input of an incomplete entry.
+	read:
+		input, err := ed.readLine(prompt)
+		if tty {
+			record(prompt, input, err)
+		}
+		if errors.Is(err, io.EOF) {
+			eof = true
+		} else if errors.Is(err, errInterrupt) {
+			// Discard the input.
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to read input: %w", err)
+		}
+		prompt = paint(promptColor, "... ")
+		// Continued lines keep their spacing, which is part of any raw
+		// string that they continue.
+		next := strings.TrimRight(input, "\r\n")
+		input = strings.TrimSpace(input)
+		if err := his.add(input); err != nil {
+			printError(err)
+		}
+		if eof && input == "" && line == "" {
 			break
 		}
-		if r == '\n' {
-			count++
+		if line == "" && (input == ".quit" || input == ".exit") {
+			break
+		}
+		if line != "" {
+			// Continue the incomplete entry.
+			line += "\n" + next
+		} else if ok, err := s.Command(input); ok {
+			if err != nil && failFast {
+				return err
+			} else if err != nil {
+				printError(err)
+			}
+			continue
+		} else {
+			line = input
+		}
+		out, err := s.Eval(line)
+		s.Page(out)
+		if errors.Is(err, repl.ErrIncomplete) && !eof {
+			goto read
+		} else if err != nil && failFast {
+			return err
+		} else if err != nil {
+			printError(err)
 		}
 	}
-	const eof = "\000igo:EOF\n"
-	end := strings.Index(output, eof)
-	if end < start {
-		end = len(output)
-	}
-	if n := end + len(eof); n < len([]rune(output)) {
-		s.rem = strings.TrimSuffix(string([]rune(output)[n:]), "\n") + "\n"
-	} else {
-		s.rem = ""
-	}
-	return string([]rune(output)[start:end])
+	return nil
 }
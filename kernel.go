@@ -0,0 +1,421 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"lesiw.io/igo/repl"
+)
+
+// protocolVersion is the version of the Jupyter messaging protocol.
+const protocolVersion = "5.3"
+
+// delimiter separates the identities of a Jupyter message from the rest.
+const delimiter = "<IDS|MSG>"
+
+// A connection is the connection file of a Jupyter kernel.
+type connection struct {
+	Transport       string `json:"transport"`
+	IP              string `json:"ip"`
+	ShellPort       int    `json:"shell_port"`
+	IOPubPort       int    `json:"iopub_port"`
+	StdinPort       int    `json:"stdin_port"`
+	ControlPort     int    `json:"control_port"`
+	HBPort          int    `json:"hb_port"`
+	Key             string `json:"key"`
+	SignatureScheme string `json:"signature_scheme"`
+}
+
+// A kernel is a Jupyter kernel that runs cells in a session.
+type kernel struct {
+	s    *repl.Session
+	key  []byte // Key that messages are signed with, if any.
+	ses  string // Session of the kernel's messages.
+	pub  *zsocket
+	cnt  int           // Execution count.
+	req  chan request  // Requests on the shell channel, in order.
+	quit chan struct{} // Closed to shut down.
+	once sync.Once     // Closes quit.
+
+	mu  sync.Mutex
+	par map[string]any // Header of the request being handled.
+}
+
+// A request is a message that a peer sent on c.
+type request struct {
+	c   *zconn
+	msg *message
+}
+
+// A message is a message of the Jupyter messaging protocol.
+type message struct {
+	ids      [][]byte // Identities of the peer.
+	header   map[string]any
+	parent   map[string]any
+	metadata map[string]any
+	content  map[string]any
+}
+
+// A stream writes to a stream of the kernel, e.g. stdout.
+type stream struct {
+	k    *kernel
+	name string
+}
+
+func (w stream) Write(b []byte) (int, error) {
+	if len(b) > 0 {
+		w.k.publish("stream",
+			map[string]any{"name": w.name, "text": string(b)})
+	}
+	return len(b), nil
+}
+
+// runKernel runs a Jupyter kernel with the connection file at pth, with a
+// session with opts, in which imp is evaluated first if it is not empty. Each
+// cell is run as if its lines were typed.
+func runKernel(pth string, opts repl.Options, imp string) error {
+	buf, err := os.ReadFile(pth)
+	if err != nil {
+		return fmt.Errorf("failed to read connection file: %w", err)
+	}
+	var cfg connection
+	if err := json.Unmarshal(buf, &cfg); err != nil {
+		return fmt.Errorf("bad connection file: %w", err)
+	}
+	if cfg.Transport != "tcp" {
+		return fmt.Errorf("unsupported transport %q", cfg.Transport)
+	}
+	if cfg.Key != "" && cfg.SignatureScheme != "hmac-sha256" {
+		return fmt.Errorf("unsupported signature scheme %q",
+			cfg.SignatureScheme)
+	}
+	k := &kernel{
+		key:  []byte(cfg.Key),
+		ses:  rand.Text(),
+		req:  make(chan request, 16),
+		quit: make(chan struct{}),
+	}
+	opts.Stdout = stream{k, "stdout"}
+	opts.Stderr = stream{k, "stderr"}
+	// The kernel has no terminal, so cells cannot run shell commands or
+	// editors.
+	opts.NoShell = true
+	if k.s, err = repl.NewSession(opts); err != nil {
+		return err
+	}
+	defer k.s.Close()
+	if imp != "" {
+		if _, err := k.s.Eval(imp); err != nil {
+			return err
+		}
+	}
+	signal.Reset(os.Interrupt)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	defer signal.Stop(sig)
+	go func() {
+		for range sig {
+			k.s.Interrupt()
+		}
+	}()
+	addr := func(port int) string {
+		return net.JoinHostPort(cfg.IP, strconv.Itoa(port))
+	}
+	queue := func(c *zconn, frames [][]byte) {
+		if msg, err := k.parse(frames); err == nil {
+			k.req <- request{c, msg}
+		}
+	}
+	if k.pub, err = listenZMQ(addr(cfg.IOPubPort), "PUB", nil); err != nil {
+		return err
+	}
+	defer k.pub.Close()
+	for _, sock := range []struct {
+		port   int
+		typ    string
+		handle func(c *zconn, frames [][]byte)
+	}{
+		{cfg.ShellPort, "ROUTER", queue},
+		{cfg.ControlPort, "ROUTER", k.control},
+		{cfg.StdinPort, "ROUTER", nil},
+		{cfg.HBPort, "REP", func(c *zconn, frames [][]byte) {
+			_ = c.send(frames)
+		}},
+	} {
+		z, err := listenZMQ(addr(sock.port), sock.typ, sock.handle)
+		if err != nil {
+			return err
+		}
+		defer z.Close()
+	}
+	go func() {
+		for r := range k.req {
+			k.handle(r.c, r.msg)
+		}
+	}()
+	<-k.quit
+	return nil
+}
+
+// control handles a message on the control channel, which is handled while
+// cells run.
+func (k *kernel) control(c *zconn, frames [][]byte) {
+	msg, err := k.parse(frames)
+	if err != nil {
+		return
+	}
+	switch msg.header["msg_type"] {
+	case "interrupt_request":
+		k.s.Interrupt()
+		k.reply(c, msg, "interrupt_reply", map[string]any{"status": "ok"})
+	case "shutdown_request":
+		k.shutdown(c, msg)
+	case "kernel_info_request":
+		k.reply(c, msg, "kernel_info_reply", k.info())
+	}
+}
+
+// handle handles a message on the shell channel.
+func (k *kernel) handle(c *zconn, msg *message) {
+	k.mu.Lock()
+	k.par = msg.header
+	k.mu.Unlock()
+	k.publish("status", map[string]any{"execution_state": "busy"})
+	defer k.publish("status", map[string]any{"execution_state": "idle"})
+	switch msg.header["msg_type"] {
+	case "kernel_info_request":
+		k.reply(c, msg, "kernel_info_reply", k.info())
+	case "execute_request":
+		k.execute(c, msg)
+	case "complete_request":
+		k.complete(c, msg)
+	case "is_complete_request":
+		code, _ := msg.content["code"].(string)
+		k.reply(c, msg, "is_complete_reply", isComplete(code))
+	case "comm_info_request":
+		k.reply(c, msg, "comm_info_reply",
+			map[string]any{"status": "ok", "comms": map[string]any{}})
+	case "history_request":
+		k.reply(c, msg, "history_reply",
+			map[string]any{"status": "ok", "history": []any{}})
+	case "shutdown_request":
+		k.shutdown(c, msg)
+	}
+}
+
+// info returns the content of a kernel_info_reply.
+func (k *kernel) info() map[string]any {
+	return map[string]any{
+		"status":                 "ok",
+		"protocol_version":       protocolVersion,
+		"implementation":         "igo",
+		"implementation_version": igoVersion(),
+		"language_info": map[string]any{
+			"name":           "go",
+			"mimetype":       "text/x-go",
+			"file_extension": ".go",
+		},
+		"banner":     version(),
+		"help_links": []any{},
+	}
+}
+
+// execute runs the code of an execute_request.
+func (k *kernel) execute(c *zconn, msg *message) {
+	code, _ := msg.content["code"].(string)
+	if silent, _ := msg.content["silent"].(bool); !silent {
+		k.cnt++
+		k.publish("execute_input",
+			map[string]any{"code": code, "execution_count": k.cnt})
+	}
+	if err := k.run(code); err != nil {
+		content := map[string]any{
+			"ename":     "error",
+			"evalue":    err.Error(),
+			"traceback": strings.Split(err.Error(), "\n"),
+		}
+		k.publish("error", content)
+		content["status"] = "error"
+		content["execution_count"] = k.cnt
+		k.reply(c, msg, "execute_reply", content)
+		return
+	}
+	k.reply(c, msg, "execute_reply", map[string]any{
+		"status":           "ok",
+		"execution_count":  k.cnt,
+		"user_expressions": map[string]any{},
+		"payload":          []any{},
+	})
+}
+
+// run runs the lines of code as if they were typed, and stops at the first
+// line that fails.
+func (k *kernel) run(code string) error {
+	out := stream{k, "stdout"}
+	var line string // Input of an incomplete entry.
+	for input := range strings.SplitSeq(code, "\n") {
+		if line != "" {
+			line += "\n" + input
+		} else if input = strings.TrimSpace(input); input == "" {
+			continue
+		} else if ok, err := k.s.Command(input); ok {
+			if err != nil {
+				return err
+			}
+			continue
+		} else {
+			line = input
+		}
+		res, err := k.s.Eval(line)
+		if res != "" {
+			fmt.Fprint(out, res)
+		}
+		if errors.Is(err, repl.ErrIncomplete) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		line = ""
+	}
+	if line != "" {
+		return repl.ErrIncomplete
+	}
+	return nil
+}
+
+// isComplete returns the content of an is_complete_reply to code, which is
+// incomplete if its last entry is, as when it is run.
+func isComplete(code string) map[string]any {
+	var line string // Input of an incomplete entry.
+	for input := range strings.SplitSeq(code, "\n") {
+		if line != "" {
+			line += "\n" + input
+		} else if input = strings.TrimSpace(input); input == "" ||
+			strings.HasPrefix(input, ".") || strings.HasPrefix(input, ":") {
+			// Commands are complete on one line.
+			continue
+		} else {
+			line = input
+		}
+		if !repl.Incomplete(line) {
+			line = ""
+		}
+	}
+	if line != "" {
+		return map[string]any{"status": "incomplete", "indent": ""}
+	}
+	return map[string]any{"status": "complete"}
+}
+
+// complete replies to a complete_request with the completions of the word
+// before the cursor.
+func (k *kernel) complete(c *zconn, msg *message) {
+	code, _ := msg.content["code"].(string)
+	pos, _ := msg.content["cursor_pos"].(float64)
+	runes := []rune(code)
+	end := min(max(int(pos), 0), len(runes))
+	part, cands := k.s.Complete(string(runes[:end]))
+	k.reply(c, msg, "complete_reply", map[string]any{
+		"status":       "ok",
+		"matches":      append([]string{}, cands...),
+		"cursor_start": end - utf8.RuneCountInString(part),
+		"cursor_end":   end,
+		"metadata":     map[string]any{},
+	})
+}
+
+// shutdown replies to a shutdown_request and shuts the kernel down.
+func (k *kernel) shutdown(c *zconn, msg *message) {
+	restart, _ := msg.content["restart"].(bool)
+	k.reply(c, msg, "shutdown_reply",
+		map[string]any{"status": "ok", "restart": restart})
+	k.once.Do(func() { close(k.quit) })
+}
+
+// parse parses the frames of a message and checks its signature.
+func (k *kernel) parse(frames [][]byte) (*message, error) {
+	i := slices.IndexFunc(frames, func(f []byte) bool {
+		return string(f) == delimiter
+	})
+	if i < 0 || len(frames) < i+6 {
+		return nil, errors.New("bad message")
+	}
+	if len(k.key) > 0 && !hmac.Equal(frames[i+1], k.sign(frames[i+2:i+6])) {
+		return nil, errors.New("bad signature")
+	}
+	msg := &message{ids: frames[:i]}
+	parts := []*map[string]any{
+		&msg.header, &msg.parent, &msg.metadata, &msg.content,
+	}
+	for j, part := range parts {
+		if err := json.Unmarshal(frames[i+2+j], part); err != nil {
+			return nil, fmt.Errorf("bad message: %w", err)
+		}
+	}
+	return msg, nil
+}
+
+// sign returns the signature of the parts of a message, or nil if the kernel
+// has no key.
+func (k *kernel) sign(parts [][]byte) []byte {
+	if len(k.key) == 0 {
+		return nil
+	}
+	h := hmac.New(sha256.New, k.key)
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return []byte(hex.EncodeToString(h.Sum(nil)))
+}
+
+// frames returns the frames of a message of type typ to the peer with ids,
+// in reply to the message with the header parent.
+func (k *kernel) frames(ids [][]byte, typ string, parent map[string]any,
+	content any) [][]byte {
+	header := map[string]any{
+		"msg_id":   rand.Text(),
+		"session":  k.ses,
+		"username": "igo",
+		"date":     time.Now().UTC().Format(time.RFC3339Nano),
+		"msg_type": typ,
+		"version":  protocolVersion,
+	}
+	if parent == nil {
+		parent = map[string]any{}
+	}
+	var parts [][]byte
+	for _, v := range []any{header, parent, map[string]any{}, content} {
+		b, _ := json.Marshal(v)
+		parts = append(parts, b)
+	}
+	frames := append(slices.Clone(ids), []byte(delimiter), k.sign(parts))
+	return append(frames, parts...)
+}
+
+// reply sends a message of type typ in reply to msg.
+func (k *kernel) reply(c *zconn, msg *message, typ string, content any) {
+	_ = c.send(k.frames(msg.ids, typ, msg.header, content))
+}
+
+// publish sends a message of type typ on the IOPub channel, in reply to the
+// request being handled.
+func (k *kernel) publish(typ string, content any) {
+	k.mu.Lock()
+	parent := k.par
+	k.mu.Unlock()
+	k.pub.broadcast(k.frames([][]byte{[]byte(typ)}, typ, parent, content))
+}
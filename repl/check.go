@@ -0,0 +1,137 @@
+package repl
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/types"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// A checked is a type-checked program.
+type checked struct {
+	pkg  *packages.Package
+	file *ast.File
+}
+
+// check type-checks src in place of the session's source file, without
+// writing or running it. Type errors are recorded in the package rather than
+// returned, so that a partially valid program can still be inspected.
+func (s *Session) check(src []byte) (*checked, error) {
+	pth, err := filepath.Abs(s.pth)
+	if err != nil {
+		return nil, fmt.Errorf("bad file %q: %w", s.pth, err)
+	}
+	if buf, err := s.goimports(pth, src); err == nil {
+		src = buf
+	}
+	cfg := &packages.Config{
+		Mode: packages.NeedName | packages.NeedTypes |
+			packages.NeedTypesInfo | packages.NeedSyntax,
+		Dir:        s.dir,
+		BuildFlags: s.flg,
+		Overlay:    map[string][]byte{pth: src},
+	}
+	pkgs, err := packages.Load(cfg, pth)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load package: %w", err)
+	}
+	if len(pkgs) != 1 || len(pkgs[0].Syntax) != 1 {
+		return nil, errors.New("failed to load package")
+	}
+	return &checked{pkg: pkgs[0], file: pkgs[0].Syntax[0]}, nil
+}
+
+// main returns the declaration of main().
+func (c *checked) main() *ast.FuncDecl {
+	for _, d := range c.file.Decls {
+		fn, ok := d.(*ast.FuncDecl)
+		if ok && fn.Recv == nil && fn.Name.Name == "main" {
+			return fn
+		}
+	}
+	return nil
+}
+
+// vars returns the variables declared at package scope and in the body of
+// main(), in declaration order.
+func (c *checked) vars() []*types.Var {
+	vars := c.locals()
+	scope := c.pkg.Types.Scope()
+	for _, name := range scope.Names() {
+		if v, ok := scope.Lookup(name).(*types.Var); ok {
+			vars = append(vars, v)
+		}
+	}
+	vars = slices.DeleteFunc(vars, func(v *types.Var) bool {
+		return strings.HasPrefix(v.Name(), "_igo")
+	})
+	slices.SortFunc(vars, func(a, b *types.Var) int {
+		return cmp.Compare(a.Pos(), b.Pos())
+	})
+	return vars
+}
+
+// locals returns the variables declared in the body of main(), including
+// those holding results, in declaration order. Variables that are redeclared
+// are returned once, as last declared.
+func (c *checked) locals() []*types.Var {
+	fn := c.main()
+	if fn == nil {
+		return nil
+	}
+	scopes := []*types.Scope{c.pkg.TypesInfo.Scopes[fn.Type]}
+	for blk := shadowBlock(fn.Body); blk != nil; blk = shadowBlock(blk) {
+		if scope := c.pkg.TypesInfo.Scopes[blk]; scope != nil {
+			scopes = append(scopes, scope)
+		}
+	}
+	var vars []*types.Var
+	seen := make(map[string]bool)
+	for _, scope := range slices.Backward(scopes) {
+		for _, name := range scope.Names() {
+			v, ok := scope.Lookup(name).(*types.Var)
+			if ok && !seen[name] {
+				seen[name] = true
+				vars = append(vars, v)
+			}
+		}
+	}
+	slices.SortFunc(vars, func(a, b *types.Var) int {
+		return cmp.Compare(a.Pos(), b.Pos())
+	})
+	return vars
+}
+
+// shadowBlock returns the block in body that the session opened to redeclare
+// variables, if any. It is the last block that follows a use of them, as in
+// "_ = x".
+func shadowBlock(body *ast.BlockStmt) *ast.BlockStmt {
+	for i := len(body.List) - 1; i > 0; i-- {
+		blk, ok := body.List[i].(*ast.BlockStmt)
+		if !ok {
+			continue
+		}
+		as, ok := body.List[i-1].(*ast.AssignStmt)
+		if !ok || len(as.Lhs) != 1 {
+			continue
+		}
+		if id, ok := as.Lhs[0].(*ast.Ident); ok && id.Name == "_" {
+			return blk
+		}
+	}
+	return nil
+}
+
+// qualifier qualifies objects from other packages by their package name.
+func (c *checked) qualifier(pkg *types.Package) string {
+	if pkg == c.pkg.Types {
+		return ""
+	}
+	return pkg.Name()
+}
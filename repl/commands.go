@@ -0,0 +1,1422 @@
+package repl
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/shlex"
+	"golang.org/x/tools/go/packages"
+)
+
+// Command runs the meta-command in input, such as .undo, or the shell command
+// in input if it starts with a colon. It reports whether input is a command.
+// Output is written to the session's Stdout.
+func (s *Session) Command(input string) (bool, error) {
+	if cmd, ok := strings.CutPrefix(input, ":"); ok {
+		if !s.shl {
+			return true, errors.New(
+				"shell commands are not available in this session")
+		}
+		return true, s.shell(cmd)
+	}
+	if n, ok := strings.CutPrefix(input, "!"); ok && isNumber(n) {
+		return true, s.history(n)
+	}
+	name, arg, _ := strings.Cut(input, " ")
+	arg = strings.TrimSpace(arg)
+	if !s.available(name, arg) {
+		return true, fmt.Errorf("%s is not available in this session", name)
+	}
+	switch name {
+	case ".reset":
+		return true, s.Reset()
+	case ".reload", ".reload!":
+		return true, s.reload(name == ".reload!")
+	case ".undo":
+		return true, s.undo()
+	case ".vars":
+		return true, s.vars()
+	case ".funcs":
+		return true, s.funcs()
+	case ".imports":
+		return true, s.printImports()
+	case ".import":
+		return true, s.importPkg(arg)
+	case ".copy":
+		return true, s.copy(arg)
+	case ".save", ".save!":
+		return true, s.save(arg, name == ".save!")
+	case ".commit":
+		return true, s.commit()
+	case ".load":
+		return true, s.load(arg)
+	case ".edit":
+		return true, s.edit(arg)
+	case ".source", ".dump":
+		return true, s.printSource(arg == "-n")
+	case ".type":
+		return true, s.printType(arg)
+	case ".doc":
+		return true, s.doc(arg)
+	case ".history":
+		return true, s.history(arg)
+	case ".list":
+		return true, s.list()
+	case ".delete":
+		return true, s.delete(arg)
+	case ".watch":
+		return true, s.watch(arg)
+	case ".unwatch":
+		return true, s.unwatch(arg)
+	case ".checkpoint":
+		return true, s.checkpoint(arg)
+	case ".rollback":
+		return true, s.rollback(arg)
+	case ".time":
+		return true, s.time(arg)
+	case ".check":
+		return true, s.checkInput(arg)
+	case ".bench":
+		return true, s.bench(arg)
+	case ".test":
+		return true, s.test(arg)
+	case ".stdin":
+		return true, s.stdin(arg)
+	case ".env":
+		return true, s.setenv(arg)
+	case ".args":
+		return true, s.args(arg)
+	case ".cd":
+		return true, s.cd(arg)
+	case ".pwd":
+		return true, s.pwd()
+	case ".dir":
+		fmt.Fprintln(s.out, s.Dir())
+		return true, nil
+	case ".capture":
+		return true, s.capture(arg)
+	case ".get":
+		return true, s.getModules(arg)
+	case ".cp":
+		return true, s.cp(arg)
+	case ".set":
+		return true, s.set(arg)
+	case ".goos":
+		return true, s.platform(&s.gos, runtime.GOOS, arg)
+	case ".goarch":
+		return true, s.platform(&s.gar, runtime.GOARCH, arg)
+	}
+	return false, nil
+}
+
+// available reports whether the command name with arg can be used, given the
+// options of the session.
+func (s *Session) available(name, arg string) bool {
+	switch name {
+	case ".capture", ".edit", ".copy":
+		return s.shl
+	case ".save", ".save!", ".commit", ".load", ".reload", ".reload!", ".cp",
+		".cd", ".get":
+		return s.fil
+	case ".stdin":
+		return s.fil || arg == "" || arg == "-" || arg[0] == '"' ||
+			arg[0] == '`'
+	case ".set":
+		opt, _, _ := strings.Cut(arg, " ")
+		return s.fil || opt != "get"
+	}
+	return true
+}
+
+// shell runs the shell command in input in the session's working directory,
+// and prints its output.
+func (s *Session) shell(input string) error {
+	argv, err := shlex.Split(input)
+	if err != nil {
+		return fmt.Errorf("bad command: %w", err)
+	} else if len(argv) == 0 {
+		return errors.New("bad command: empty command")
+	}
+	if argv[0] == "cd" {
+		// A shell would change its own directory, so change the session's.
+		if len(argv) > 2 {
+			return errors.New("usage: :cd [DIR]")
+		}
+		return s.cd(strings.Join(argv[1:], ""))
+	}
+	// Output is written as it is printed, so that long commands show their
+	// progress.
+	return s.runShell(argv, s.out)
+}
+
+// runShell runs the command in argv in the session's working directory, and
+// writes its output to stdout and its error output to the session's Stderr.
+func (s *Session) runShell(argv []string, stdout io.Writer) error {
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Dir = s.cwd
+	cmd.Env = s.environ()
+	cmd.Stdout, cmd.Stderr = stdout, s.err
+	err := s.wait(cmd, 0)
+	if errors.Is(err, ErrInterrupt) {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("command failed: %w", err)
+	}
+	return nil
+}
+
+// history prints the numbered entries of the session or, if n is set, runs
+// the input of entry n again.
+func (s *Session) history(n string) error {
+	if n == "" {
+		var b strings.Builder
+		for i, e := range s.usr {
+			text := e.inp
+			if text == "" {
+				text = e.imp + e.pkg + e.usr
+			}
+			writeEntry(&b, i+1, text)
+		}
+		s.page(b.String())
+		return nil
+	}
+	i, err := strconv.Atoi(n)
+	if err != nil || i < 1 || i > len(s.usr) {
+		return fmt.Errorf("no entry %s", n)
+	}
+	input := s.usr[i-1].inp
+	if input == "" {
+		return fmt.Errorf("entry %d was not typed, so it cannot run again", i)
+	} else if ok, err := s.Command(input); ok {
+		return err
+	}
+	out, err := s.Eval(input)
+	fmt.Fprint(s.out, out)
+	return err
+}
+
+// list prints the code of the numbered entries of the session, formatted.
+// Expressions are listed as they were typed.
+func (s *Session) list() error {
+	var b strings.Builder
+	for i, e := range s.usr {
+		usr := e.usr
+		if e.val != nil {
+			usr = e.inp
+		}
+		var parts []string
+		for _, code := range []string{e.imp + e.pkg, usr} {
+			if strings.TrimSpace(code) == "" {
+				continue
+			}
+			if buf, err := format.Source([]byte(code)); err == nil {
+				code = string(buf)
+			}
+			parts = append(parts, strings.TrimSpace(code))
+		}
+		writeEntry(&b, i+1, strings.Join(parts, "\n"))
+	}
+	s.page(b.String())
+	return nil
+}
+
+// writeEntry writes text to w as entry n, with its lines indented to line up.
+func writeEntry(w io.Writer, n int, text string) {
+	text = strings.TrimSpace(text)
+	text = strings.ReplaceAll(text, "\n", "\n      ")
+	fmt.Fprintf(w, "%4d  %s\n", n, text)
+}
+
+// stdin sets the standard input of programs to the Go string literal in arg or
+// the contents of the file it names, or prints it if arg is empty. An argument
+// of - removes it.
+func (s *Session) stdin(arg string) error {
+	switch {
+	case arg == "":
+		if s.inp == nil {
+			fmt.Fprintln(s.out, "no stdin")
+		} else {
+			fmt.Fprintln(s.out, strconv.Quote(string(s.inp)))
+		}
+		return nil
+	case arg == "-":
+		s.inp = nil
+		return nil
+	case arg[0] == '"' || arg[0] == '`':
+		text, err := strconv.Unquote(arg)
+		if err != nil {
+			return fmt.Errorf("bad string: %s", arg)
+		}
+		s.inp = []byte(text)
+		return nil
+	}
+	buf, err := os.ReadFile(s.hostPath(arg))
+	if err != nil {
+		return fmt.Errorf("failed to read stdin: %w", err)
+	}
+	s.inp = buf
+	return nil
+}
+
+// capture runs the shell command in arg, after the name of a variable, and
+// declares the variable as a string holding its output, without surrounding
+// space.
+func (s *Session) capture(arg string) error {
+	name, line, _ := strings.Cut(arg, " ")
+	argv, err := shlex.Split(line)
+	if !token.IsIdentifier(name) || err != nil || len(argv) == 0 {
+		return errors.New("usage: .capture NAME COMMAND")
+	}
+	var buf bytes.Buffer
+	if err := s.runShell(argv, &buf); err != nil {
+		return err
+	}
+	val := strconv.Quote(strings.TrimSpace(buf.String()))
+	out, err := s.Eval(name + " := " + val)
+	fmt.Fprint(s.out, out)
+	return err
+}
+
+// cd changes the working directory of programs and shell commands to dir,
+// relative to the current one, or back to the session's directory if dir is
+// empty.
+func (s *Session) cd(dir string) error {
+	if dir == "" {
+		s.cwd = s.dir
+		return nil
+	}
+	if rest, ok := strings.CutPrefix(dir, "~"); ok &&
+		(rest == "" || os.IsPathSeparator(rest[0])) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return fmt.Errorf("failed to find home directory: %w", err)
+		}
+		dir = home + rest
+	}
+	dir, err := filepath.Abs(s.hostPath(dir))
+	if err != nil {
+		return fmt.Errorf("failed to change directory: %w", err)
+	}
+	if info, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("failed to change directory: %w", err)
+	} else if !info.IsDir() {
+		return fmt.Errorf("failed to change directory: %s is not a directory",
+			dir)
+	}
+	s.cwd = dir
+	return nil
+}
+
+// pwd prints the working directory of programs and shell commands.
+func (s *Session) pwd() error {
+	dir, err := filepath.Abs(s.cwd)
+	if err != nil {
+		return fmt.Errorf("failed to get working directory: %w", err)
+	}
+	fmt.Fprintln(s.out, dir)
+	return nil
+}
+
+// getModules runs go get for each module in arg, with an optional version
+// suffix, e.g. @v1.2.3 or @latest.
+func (s *Session) getModules(arg string) error {
+	mods := strings.Fields(arg)
+	if len(mods) == 0 {
+		return errors.New("usage: .get MODULE[@VERSION]...")
+	}
+	for _, mod := range mods {
+		if err := s.goGet(mod); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// args sets the arguments of programs to those in arg, which are split like
+// the arguments of a shell command, or prints them if arg is empty. An argument
+// of - removes them.
+func (s *Session) args(arg string) error {
+	switch arg {
+	case "":
+		quoted := make([]string, len(s.arg))
+		for i, a := range s.arg {
+			quoted[i] = strconv.Quote(a)
+		}
+		fmt.Fprintln(s.out, strings.Join(quoted, " "))
+		return nil
+	case "-":
+		s.arg = nil
+		return nil
+	}
+	argv, err := shlex.Split(arg)
+	if err != nil {
+		return fmt.Errorf("bad arguments: %w", err)
+	}
+	s.arg = argv
+	return nil
+}
+
+// set sets the option in arg, of the form NAME VALUE, or prints the options
+// if arg is empty. Options take effect on the next run.
+func (s *Session) set(arg string) error {
+	opts := []struct {
+		name string
+		val  *bool
+		not  bool // Whether the option is the opposite of val.
+	}{
+		{"autoprint", &s.aut, false},
+		{"color", &s.col, false},
+		{"deterministic", &s.det, false},
+		{"get", &s.get, false},
+		{"helpers", &s.hlp, false},
+		{"pager", &s.pag, false},
+		{"race", &s.rac, false},
+		{"shadow-warn", &s.shw, false},
+		{"strict", &s.fix, true},
+		{"trace", &s.trc, false},
+		{"truncate", &s.trn, false},
+	}
+	if arg == "" {
+		for _, o := range opts {
+			state := "off"
+			if *o.val != o.not {
+				state = "on"
+			}
+			fmt.Fprintf(s.out, "%-14s %s\n", o.name, state)
+		}
+		fmt.Fprintf(s.out, "%-14s %s\n", "timeout", s.lim)
+		return nil
+	}
+	name, val, _ := strings.Cut(arg, " ")
+	val = strings.TrimSpace(val)
+	if name == "timeout" {
+		lim, err := time.ParseDuration(val)
+		if err != nil || lim < 0 {
+			return fmt.Errorf("bad timeout: %q", val)
+		}
+		s.lim = lim
+		return nil
+	}
+	for _, o := range opts {
+		if o.name != name {
+			continue
+		}
+		switch val {
+		case "on":
+			*o.val = !o.not
+		case "off":
+			*o.val = o.not
+		default:
+			return fmt.Errorf("usage: .set %s on|off", name)
+		}
+		// The program is built again, in case its flags changed.
+		s.sum = [sha256.Size]byte{}
+		return nil
+	}
+	return fmt.Errorf("unknown option: %q", name)
+}
+
+// platform sets *val, the GOOS or GOARCH that .check builds for, to arg, or
+// prints it, or host if it is empty, if arg is empty. An argument of - sets it
+// back to host.
+func (s *Session) platform(val *string, host, arg string) error {
+	switch arg {
+	case "":
+		fmt.Fprintln(s.out, cmp.Or(*val, host))
+	case "-", host:
+		*val = ""
+	default:
+		*val = arg
+	}
+	return nil
+}
+
+// cp copies the files in arg, relative to the working directory, to the
+// directory of the program, e.g. to embed them with //go:embed. The files of
+// the module cannot be replaced, and neither can the files next to a session's
+// File, other than those that were copied, which are removed when the session
+// is closed.
+func (s *Session) cp(arg string) error {
+	pths, err := shlex.Split(arg)
+	if err != nil {
+		return fmt.Errorf("bad arguments: %w", err)
+	} else if len(pths) == 0 {
+		return errors.New("usage: .cp FILE...")
+	}
+	for _, pth := range pths {
+		name := filepath.Base(pth)
+		switch name {
+		case "go.mod", "go.sum", "go.work", "go.work.sum",
+			filepath.Base(s.pth):
+			return fmt.Errorf("cannot copy %s: it would replace the "+
+				"program's %s", pth, name)
+		}
+		dst := filepath.Join(filepath.Dir(s.pth), name)
+		if _, err := os.Stat(dst); err == nil && s.org != nil &&
+			!slices.Contains(s.cpd, dst) {
+			return fmt.Errorf("cannot copy %s: %s already exists", pth, dst)
+		}
+		buf, err := os.ReadFile(s.hostPath(pth))
+		if err != nil {
+			return fmt.Errorf("failed to read file: %w", err)
+		}
+		if err := os.WriteFile(dst, buf, 0644); err != nil {
+			return fmt.Errorf("failed to write file: %w", err)
+		}
+		if s.org != nil && !slices.Contains(s.cpd, dst) {
+			s.cpd = append(s.cpd, dst)
+		}
+	}
+	return nil
+}
+
+// setenv sets the environment variable in arg, of the form KEY=VALUE, or
+// unsets it if arg is only KEY, for programs and shell commands. If arg is
+// empty, it prints the variables that were set or unset.
+func (s *Session) setenv(arg string) error {
+	if arg == "" {
+		for _, kv := range s.env {
+			if strings.Contains(kv, "=") {
+				fmt.Fprintln(s.out, kv)
+			} else {
+				fmt.Fprintln(s.out, kv, "(unset)")
+			}
+		}
+		return nil
+	}
+	key, _, _ := strings.Cut(arg, "=")
+	if key == "" || strings.ContainsAny(key, " \t") {
+		return errors.New("usage: .env [KEY[=VALUE]]")
+	}
+	s.env = slices.DeleteFunc(s.env, func(kv string) bool {
+		k, _, _ := strings.Cut(kv, "=")
+		return k == key
+	})
+	s.env = append(s.env, arg)
+	return nil
+}
+
+// time evaluates input and prints how long it took, and how much of that was
+// spent building and running the program. Unless the session is stateful, the
+// program runs the earlier input too, so that is included.
+func (s *Session) time(input string) error {
+	if input == "" {
+		return errors.New("usage: .time STATEMENT")
+	}
+	s.bld, s.exe = 0, 0
+	start := time.Now()
+	out, err := s.evalInput(input)
+	elapsed := time.Since(start)
+	fmt.Fprint(s.out, out)
+	if err != nil {
+		return err
+	}
+	note := ", including earlier lines"
+	if s.sta != "" {
+		note = ""
+	}
+	fmt.Fprintf(s.out, "elapsed: %v (build %v, run %v%s)\n", round(elapsed),
+		round(s.bld), round(s.exe), note)
+	return nil
+}
+
+// checkInput builds the program with input appended, for the platform set by
+// .goos and .goarch, without running it or adding input to the session, and
+// prints ok if it compiles.
+func (s *Session) checkInput(input string) error {
+	if input == "" {
+		return errors.New("usage: .check STATEMENT")
+	}
+	s.chk = true
+	defer func() { s.chk = false }()
+	if _, err := s.Eval(input); err != nil {
+		return err
+	}
+	if s.gos != "" || s.gar != "" {
+		fmt.Fprintf(s.out, "ok for %s/%s\n", cmp.Or(s.gos, runtime.GOOS),
+			cmp.Or(s.gar, runtime.GOARCH))
+		return nil
+	}
+	fmt.Fprintln(s.out, "ok")
+	return nil
+}
+
+// benchCode benchmarks the statement %s with testing.Benchmark, which runs it
+// for about a second.
+const benchCode = `_igoBench := testing.Benchmark(func(b *testing.B) {
+	b.ReportAllocs()
+	for b.Loop() {
+		%s
+	}
+})
+fmt.Println(strings.TrimSpace(_igoBench.String()) + "\t" +
+	_igoBench.MemString())
+`
+
+// bench benchmarks the expression or statement in input, after running the
+// session as setup, and prints the time and allocations per run. The session
+// is left as is.
+func (s *Session) bench(input string) error {
+	if input == "" {
+		return errors.New("usage: .bench EXPR")
+	}
+	raw := s.rebind(input)
+	lhs := "_"
+	for {
+		stmt := raw
+		if lhs != "" && exprEnd(raw) >= 0 {
+			stmt = lhs + " = " + raw
+		}
+		code := fmt.Sprintf(benchCode, stmt)
+		out, err := s.probe(entry{usr: code, lns: strings.Count(code, "\n")})
+		fmt.Fprint(s.out, out)
+		var be buildError
+		if !errors.As(err, &be) {
+			return err
+		}
+		retry := false
+		for line := range strings.SplitSeq(be.out, "\n") {
+			m := builderr.FindStringSubmatch(line)
+			if m == nil {
+				continue
+			}
+			if strings.HasSuffix(m[4], novalue) && lhs != "" {
+				// The expression has no value, so it is a statement.
+				retry, lhs = true, ""
+			} else if n := mismatch.FindStringSubmatch(m[4]); n != nil {
+				// The expression has multiple values.
+				count, _ := strconv.Atoi(n[1])
+				retry = count > 1 && lhs != ""
+				lhs = strings.Repeat("_, ", count-1) + "_"
+			}
+		}
+		if !retry {
+			return err
+		}
+	}
+}
+
+// probe runs the program with e appended and returns its new output, leaving
+// the session as is.
+func (s *Session) probe(e entry) (string, error) {
+	usr, frm, efm, ran, unu := s.usr, s.frm, s.efm, s.ran, s.unu
+	rem, erm, lst, xit := s.rem, s.erm, s.lst, s.xit
+	defer func() {
+		s.usr, s.frm, s.efm, s.ran, s.unu = usr, frm, efm, ran, unu
+		s.rem, s.erm, s.lst, s.xit = rem, erm, lst, xit
+	}()
+	return s.eval(e)
+}
+
+// round rounds d to 3 significant digits.
+func round(d time.Duration) time.Duration {
+	unit := time.Duration(1)
+	for d >= 1000*unit {
+		unit *= 10
+	}
+	return d.Round(unit)
+}
+
+// isNumber reports whether s is a decimal number.
+func isNumber(s string) bool {
+	_, err := strconv.ParseUint(s, 10, 0)
+	return err == nil
+}
+
+// undo removes the last entry from the session.
+func (s *Session) undo() error {
+	if len(s.usr) == 0 {
+		return errors.New("nothing to undo")
+	}
+	s.frm = max(s.frm-s.usr[len(s.usr)-1].out, 0)
+	s.efm = max(s.efm-s.usr[len(s.usr)-1].err, 0)
+	s.usr = s.usr[:len(s.usr)-1]
+	s.ran = min(s.ran, len(s.usr))
+	s.unu = nil
+	s.lastVal()
+	return nil
+}
+
+// delete removes entry n from the session and runs the program again,
+// printing all of its output. If the program fails, the session is left as
+// is.
+func (s *Session) delete(n string) error {
+	if n == "" {
+		return errors.New("usage: .delete N")
+	}
+	i, err := strconv.Atoi(n)
+	if err != nil || i < 1 || i > len(s.usr) {
+		return fmt.Errorf("no entry %s", n)
+	}
+	return s.replace(slices.Delete(slices.Clone(s.usr), i-1, i))
+}
+
+// watch adds the expression in arg to the watches, which are printed after
+// each input, and prints them, or lists them if arg is empty.
+func (s *Session) watch(arg string) error {
+	if arg == "" {
+		for i, w := range s.wat {
+			writeEntry(s.out, i+1, w)
+		}
+		return nil
+	}
+	s.wat = append(s.wat, arg)
+	out, err := s.watches()
+	if err != nil {
+		s.wat = s.wat[:len(s.wat)-1]
+		return err
+	}
+	fmt.Fprint(s.out, out)
+	return nil
+}
+
+// unwatch removes watch n.
+func (s *Session) unwatch(n string) error {
+	if n == "" {
+		return errors.New("usage: .unwatch N")
+	}
+	i, err := strconv.Atoi(n)
+	if err != nil || i < 1 || i > len(s.wat) {
+		return fmt.Errorf("no watch %s", n)
+	}
+	s.wat = slices.Delete(s.wat, i-1, i)
+	return nil
+}
+
+// watches returns the values of the watches, each after its expression, by
+// running the program with the session, which is left as is.
+func (s *Session) watches() (string, error) {
+	if len(s.wat) == 0 {
+		return "", nil
+	}
+	code := s.watchCode()
+	return s.probe(entry{usr: code, lns: strings.Count(code, "\n")})
+}
+
+// watchCode returns the code that prints the values of the watches, each after
+// its expression.
+func (s *Session) watchCode() string {
+	var code strings.Builder
+	for i, w := range s.wat {
+		fmt.Fprintf(&code, watchStmt, w+" = ", s.rebind(w), i+1,
+			s.linePath("watch"))
+	}
+	return code.String()
+}
+
+// A checkpoint is the state of a session that can be restored.
+type checkpoint struct {
+	usr []entry
+	pin []string
+	rmi []string
+	env []string
+	arg []string
+	inp []byte
+	cwd string
+}
+
+// checkpoint saves the state of the session as the checkpoint name, which may
+// be empty.
+func (s *Session) checkpoint(name string) error {
+	if s.cps == nil {
+		s.cps = make(map[string]checkpoint)
+	}
+	s.cps[name] = checkpoint{
+		usr: slices.Clone(s.usr),
+		pin: slices.Clone(s.pin),
+		rmi: slices.Clone(s.rmi),
+		env: slices.Clone(s.env),
+		arg: slices.Clone(s.arg),
+		inp: slices.Clone(s.inp),
+		cwd: s.cwd,
+	}
+	return nil
+}
+
+// rollback restores the checkpoint name, which may be empty, and runs the
+// program again, printing all of its output. If the program fails, the session
+// is left as is.
+func (s *Session) rollback(name string) error {
+	cp, ok := s.cps[name]
+	if !ok && name == "" {
+		return errors.New("no checkpoint; type .checkpoint to make one")
+	} else if !ok {
+		return fmt.Errorf("no checkpoint %q", name)
+	}
+	old := checkpoint{pin: s.pin, rmi: s.rmi, env: s.env, arg: s.arg,
+		inp: s.inp, cwd: s.cwd}
+	s.pin, s.rmi = slices.Clone(cp.pin), slices.Clone(cp.rmi)
+	s.env, s.arg = slices.Clone(cp.env), slices.Clone(cp.arg)
+	s.inp, s.cwd = slices.Clone(cp.inp), cp.cwd
+	if err := s.replace(slices.Clone(cp.usr)); err != nil {
+		s.pin, s.rmi, s.env, s.arg = old.pin, old.rmi, old.env, old.arg
+		s.inp, s.cwd = old.inp, old.cwd
+		return err
+	}
+	return nil
+}
+
+// reload reads the session's file again, after it is edited, and runs the
+// session's entries again on top of it, unless discard is set.
+func (s *Session) reload(discard bool) error {
+	if s.org == nil {
+		return errors.New("nothing to reload: the session has no file")
+	}
+	buf, err := os.ReadFile(s.pth)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+	_, err = parser.ParseFile(token.NewFileSet(), s.pth, buf, 0)
+	if err != nil {
+		return fmt.Errorf("failed to parse: %w", err)
+	}
+	usr := s.usr
+	s.org = buf
+	if err := s.Reset(); err != nil {
+		return err
+	}
+	if discard {
+		return nil
+	}
+	return s.replace(usr)
+}
+
+// replace replaces the session's entries with usr and runs the program again,
+// printing all of its output. If the program fails, the session is left as
+// is.
+func (s *Session) replace(usr []entry) error {
+	old, frm, efm, val, unu := s.usr, s.frm, s.efm, s.val, s.unu
+	s.usr, s.frm, s.efm, s.unu = nil, 0, 0, nil
+	if s.sta != "" {
+		// Run everything again, since the state is replaced.
+		s.ran = 0
+		_ = os.Remove(s.sta)
+	}
+	if len(usr) == 0 {
+		s.lastVal()
+		return nil
+	}
+	for _, e := range usr[:len(usr)-1] {
+		e.out, e.err = 0, 0
+		s.usr = append(s.usr, e)
+	}
+	out, err := s.eval(usr[len(usr)-1])
+	fmt.Fprint(s.out, out)
+	if err != nil {
+		s.usr, s.frm, s.efm, s.val, s.unu = old, frm, efm, val, unu
+		return err
+	}
+	s.lastVal()
+	return nil
+}
+
+// lastVal binds the last results to the variables of the last entry that has
+// any.
+func (s *Session) lastVal() {
+	s.val = nil
+	for _, e := range s.usr {
+		if e.val != nil {
+			s.val = e.val
+		}
+	}
+}
+
+// A Var is a variable declared in the session.
+type Var struct {
+	Name  string
+	Type  string
+	Value string // Formatted with %+v.
+}
+
+// varPrefix marks the lines that Vars prints values on.
+const varPrefix = "_igoVar "
+
+// varCode prints the value of the variable %s, quoted, after varPrefix.
+const varCode = `fmt.Printf("_igoVar %%q\n", fmt.Sprintf("%%+v", %s))` + "\n"
+
+// Vars returns the variables declared in the session, in declaration order,
+// with their types and values. The values are printed by running the program
+// with the session, which is left as is.
+func (s *Session) Vars() ([]Var, error) {
+	c, err := s.check(s.source(entry{}))
+	if err != nil {
+		return nil, err
+	}
+	var vars []Var
+	var code strings.Builder
+	for _, v := range c.vars() {
+		vars = append(vars, Var{
+			Name: v.Name(),
+			Type: types.TypeString(v.Type(), c.qualifier),
+		})
+		fmt.Fprintf(&code, varCode, v.Name())
+	}
+	if len(vars) == 0 {
+		return nil, nil
+	}
+	out, err := s.probe(entry{usr: code.String(), lns: len(vars)})
+	if err != nil {
+		return nil, err
+	}
+	var i int
+	for line := range strings.SplitSeq(out, "\n") {
+		val, ok := strings.CutPrefix(line, varPrefix)
+		if !ok || i == len(vars) {
+			continue
+		}
+		if vars[i].Value, err = strconv.Unquote(val); err != nil {
+			return nil, fmt.Errorf("failed to read value of %s: %w",
+				vars[i].Name, err)
+		}
+		i++
+	}
+	return vars, nil
+}
+
+// vars prints the variables declared in the session, with their types and
+// values, as Vars returns them.
+func (s *Session) vars() error {
+	vars, err := s.Vars()
+	if err != nil {
+		return err
+	}
+	for _, v := range vars {
+		fmt.Fprintf(s.out, "%s %s = %s\n", v.Name, v.Type, v.Value)
+	}
+	return nil
+}
+
+// funcs prints the signatures of the functions and methods declared in the
+// session, in declaration order, each after the first line of its doc comment.
+func (s *Session) funcs() error {
+	var b strings.Builder
+	b.WriteString("package main\n")
+	for _, e := range s.usr {
+		if e.pkg != "" {
+			b.WriteString(e.pkg)
+		} else if isBlank(e.usr) {
+			// Comments typed before a function are its doc comment.
+			b.WriteString(e.usr)
+		} else {
+			b.WriteString("\n")
+		}
+	}
+	fs := token.NewFileSet()
+	root, err := parser.ParseFile(fs, "", b.String(), parser.ParseComments)
+	if err != nil {
+		return fmt.Errorf("failed to parse declarations: %w", err)
+	}
+	for _, d := range root.Decls {
+		fn, ok := d.(*ast.FuncDecl)
+		if !ok {
+			continue
+		}
+		if fn.Doc != nil {
+			doc, _, _ := strings.Cut(strings.TrimSpace(fn.Doc.Text()), "\n")
+			fmt.Fprintln(s.out, "//", doc)
+		}
+		sig := *fn
+		sig.Doc, sig.Body = nil, nil
+		var buf bytes.Buffer
+		if err := format.Node(&buf, fs, &sig); err != nil {
+			return fmt.Errorf("failed to format %s: %w", fn.Name.Name, err)
+		}
+		fmt.Fprintln(s.out, buf.String())
+	}
+	return nil
+}
+
+// importSpecs returns the imports of the program, as they are built, other
+// than those that only igo's own code uses.
+func (s *Session) importSpecs() ([]*ast.ImportSpec, error) {
+	s.bar = true
+	src := s.program(entry{})
+	s.bar = false
+	buf, err := s.goimports(s.pth, src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to process imports: %w", err)
+	}
+	buf = blankImports(buf, s.rmi)
+	root, err := parser.ParseFile(token.NewFileSet(), "", buf,
+		parser.ImportsOnly)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse imports: %w", err)
+	}
+	return root.Imports, nil
+}
+
+// printImports prints the imports of the program, including those added by
+// goimports, and then the typed imports that are not used.
+func (s *Session) printImports() error {
+	specs, err := s.importSpecs()
+	if err != nil {
+		return err
+	}
+	have := make(map[string]bool)
+	for _, spec := range specs {
+		have[importKey(spec)] = true
+		fmt.Fprintln(s.out, importKey(spec))
+	}
+	for _, e := range s.usr {
+		root, err := parser.ParseFile(token.NewFileSet(), "",
+			"package main\n"+e.imp, parser.ImportsOnly)
+		if err != nil {
+			continue
+		}
+		for _, spec := range root.Imports {
+			if key := importKey(spec); !have[key] {
+				have[key] = true
+				fmt.Fprintln(s.out, key, "(not used)")
+			}
+		}
+	}
+	return nil
+}
+
+// importPkg imports the package in arg, optionally named, which is kept even
+// while it is not used, or removes its import if arg starts with -rm. A
+// removed import is blank, so its name can refer to another package.
+func (s *Session) importPkg(arg string) error {
+	pkg, rm := strings.CutPrefix(arg, "-rm ")
+	pkg = strings.TrimSpace(pkg)
+	if pkg == "" || strings.HasPrefix(pkg, "-") {
+		return errors.New("usage: .import [-rm] [NAME] PKG")
+	}
+	name, pkg, ok := strings.Cut(pkg, " ")
+	if !ok {
+		name, pkg = "", name
+	} else if rm {
+		return errors.New("usage: .import -rm PKG")
+	}
+	pkg = strings.TrimSpace(pkg)
+	if unq, err := strconv.Unquote(pkg); err == nil {
+		pkg = unq
+	}
+	path := strconv.Quote(pkg)
+	if !rm {
+		rmi := s.rmi
+		s.rmi = slices.DeleteFunc(slices.Clone(s.rmi), func(p string) bool {
+			return p == path
+		})
+		spec := path
+		if name != "" {
+			spec = name + " " + path
+		}
+		out, err := s.Eval("import " + spec)
+		fmt.Fprint(s.out, out)
+		if err != nil {
+			s.rmi = rmi
+		}
+		return err
+	}
+	specs, err := s.importSpecs()
+	if err != nil {
+		return err
+	}
+	if !slices.ContainsFunc(specs, func(spec *ast.ImportSpec) bool {
+		return spec.Path.Value == path && spec.Name.String() != "_"
+	}) {
+		return fmt.Errorf("%s is not imported", pkg)
+	}
+	s.rmi = append(s.rmi, path)
+	return nil
+}
+
+// printType prints the type of the expression expr, without running it.
+func (s *Session) printType(expr string) error {
+	if expr == "" {
+		return errors.New("usage: .type EXPR")
+	}
+	if _, err := parser.ParseExpr(expr); err != nil {
+		return fmt.Errorf("bad expression: %w", err)
+	}
+	const name = "_igoType"
+	c, err := s.check(s.source(entry{usr: name + " := " + expr + "\n"}))
+	if err != nil {
+		return err
+	}
+	var typ types.Type
+	ast.Inspect(c.file, func(n ast.Node) bool {
+		as, ok := n.(*ast.AssignStmt)
+		if !ok || len(as.Lhs) != 1 || len(as.Rhs) != 1 {
+			return true
+		}
+		if id, ok := as.Lhs[0].(*ast.Ident); ok && id.Name == name {
+			typ = c.pkg.TypesInfo.TypeOf(as.Rhs[0])
+		}
+		return true
+	})
+	if typ == nil || typ == types.Typ[types.Invalid] {
+		for _, e := range c.pkg.Errors {
+			if e.Kind == packages.TypeError && e.Msg != unused+name {
+				return errors.New(e.Msg)
+			}
+		}
+		return fmt.Errorf("bad expression: %s", expr)
+	}
+	fmt.Fprintln(s.out, types.TypeString(typ, c.qualifier))
+	return nil
+}
+
+// save writes the session to pth as a standalone program. Unless force is set,
+// it refuses to overwrite an existing file.
+func (s *Session) save(pth string, force bool) error {
+	if pth == "" {
+		return errors.New("usage: .save FILE")
+	}
+	dst := s.hostPath(pth)
+	if _, err := os.Stat(dst); err == nil && !force {
+		return fmt.Errorf("%s already exists; use .save! to overwrite", pth)
+	}
+	src, err := s.standalone()
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(dst, src, 0644); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	return nil
+}
+
+// clipboards are commands that copy their input to the clipboard, and the
+// environment variable that must be set for them to work, if any.
+var clipboards = []struct {
+	env  string
+	argv []string
+}{
+	{"", []string{"pbcopy"}},
+	{"WAYLAND_DISPLAY", []string{"wl-copy"}},
+	{"DISPLAY", []string{"xclip", "-selection", "clipboard"}},
+	{"DISPLAY", []string{"xsel", "--clipboard", "--input"}},
+	{"", []string{"clip.exe"}},
+}
+
+// copy copies the output of the last entry, or the session as a standalone
+// program if arg is source, to the clipboard. If there is no clipboard command,
+// it prints the text instead.
+func (s *Session) copy(arg string) error {
+	var text string
+	switch arg {
+	case "":
+		text = s.lst
+	case "source":
+		src, err := s.standalone()
+		if err != nil {
+			return err
+		}
+		text = string(src)
+	default:
+		return errors.New("usage: .copy [source]")
+	}
+	for _, c := range clipboards {
+		if c.env != "" && os.Getenv(c.env) == "" {
+			continue
+		} else if _, err := exec.LookPath(c.argv[0]); err != nil {
+			continue
+		}
+		cmd := exec.Command(c.argv[0], c.argv[1:]...)
+		cmd.Stdin = strings.NewReader(text)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to copy: %s",
+				cmp.Or(strings.TrimSpace(string(out)), err.Error()))
+		}
+		return nil
+	}
+	fmt.Fprint(s.out, text)
+	return errors.New("no clipboard command found, so the text is printed; " +
+		"install pbcopy, wl-copy, xclip, or xsel")
+}
+
+// standalone returns the session as a program that builds on its own, without
+// the internals of igo. Values are printed with fmt.Println, since the program
+// does not declare _igoPrint.
+func (s *Session) standalone() ([]byte, error) {
+	usr := s.usr
+	s.usr = plainEntries(usr)
+	s.bar = true
+	defer func() { s.usr, s.bar = usr, false }()
+	c, err := s.check(s.program(entry{}))
+	if err != nil {
+		return nil, err
+	}
+	// Variables that are still unused must be used for the program to build.
+	var fixes strings.Builder
+	for _, e := range c.pkg.Errors {
+		if strings.HasPrefix(e.Msg, unused) {
+			fixes.WriteString("_ = " + e.Msg[len(unused):] + "\n")
+		}
+	}
+	src := s.program(entry{usr: fixes.String()})
+	src, err = s.goimports(s.pth, src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to process imports: %w", err)
+	}
+	return src, nil
+}
+
+// plainEntries returns usr with the expressions that were printed or used
+// through the variables of their results printed with fmt.Println or assigned
+// to _ instead. The variables of results that later entries refer to, as _ or
+// _N, are kept, named resN_M.
+func plainEntries(usr []entry) []entry {
+	usr = slices.Clone(usr)
+	for i, e := range usr {
+		if e.val == nil || slices.ContainsFunc(usr[i+1:], func(f entry) bool {
+			return slices.ContainsFunc(e.val, func(v string) bool {
+				return strings.Contains(f.usr, v)
+			})
+		}) {
+			continue
+		}
+		lhs := strings.Join(e.val, ", ")
+		rest, ok := strings.CutPrefix(e.usr, lhs+" := ")
+		if !ok {
+			continue
+		}
+		if expr, tail, ok := strings.Cut(rest, "\n_igoPrint("+lhs+")"); ok {
+			usr[i].usr = "fmt.Println(" + expr + ")" + tail
+		} else if expr, tail, ok := strings.Cut(rest,
+			"\n"+strings.Repeat("_, ", len(e.val)-1)+"_ = "+lhs); ok {
+			usr[i].usr = strings.Repeat("_, ", len(e.val)-1) + "_ = " +
+				expr + tail
+		}
+	}
+	for i, e := range usr {
+		text := strings.ReplaceAll(e.usr, "_igoPrint(", "fmt.Println(")
+		usr[i].usr = igoresult.ReplaceAllString(text, "res$1")
+	}
+	return usr
+}
+
+// withPackage returns src with the package clause of org, the source of the
+// session's file, which programs are built from as package main.
+func withPackage(src, org []byte) []byte {
+	f, err := parser.ParseFile(token.NewFileSet(), "", org,
+		parser.PackageClauseOnly)
+	if err != nil || f.Name.Name == "main" {
+		return src
+	}
+	fs := token.NewFileSet()
+	root, err := parser.ParseFile(fs, "", src, parser.PackageClauseOnly)
+	if err != nil {
+		return src
+	}
+	i := fs.Position(root.Name.Pos()).Offset
+	j := fs.Position(root.Name.End()).Offset
+	return slices.Concat(src[:i], []byte(f.Name.Name), src[j:])
+}
+
+// commit writes the session to its file, which keeps the lines of the session
+// when the session is closed.
+func (s *Session) commit() error {
+	if s.org == nil {
+		return errors.New("nothing to commit to: the session has no file; " +
+			"use .save FILE")
+	}
+	src, err := s.standalone()
+	if err != nil {
+		return err
+	}
+	src = withPackage(src, s.org)
+	if err := os.WriteFile(s.pth, src, 0644); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	// The output of the lines is now the output of the file.
+	frm, efm, rem, erm := s.frm, s.efm, s.rem, s.erm
+	res, val := s.res, s.val
+	s.org = src
+	if err := s.Reset(); err != nil {
+		return err
+	}
+	s.frm, s.efm, s.rem, s.erm = frm, efm, rem, erm
+	s.res, s.val = res, val
+	return nil
+}
+
+// hostPath returns the path of the file of the host that pth names, which is
+// relative to the working directory of programs unless it is absolute.
+func (s *Session) hostPath(pth string) string {
+	if filepath.IsAbs(pth) {
+		return pth
+	}
+	return filepath.Join(s.cwd, pth)
+}
+
+// load evaluates the Go file at pth as a single entry. Its declarations are
+// added at package scope and the body of its main(), if any, is added to the
+// body of main(). Imports that the session already has are skipped.
+func (s *Session) load(pth string) error {
+	if pth == "" {
+		return errors.New("usage: .load FILE|DIR")
+	}
+	src := s.hostPath(pth)
+	if fi, err := os.Stat(src); err == nil && fi.IsDir() {
+		return s.loadPkg(src)
+	}
+	buf, err := os.ReadFile(src)
+	if err != nil {
+		return fmt.Errorf("bad file %q: %w", pth, err)
+	}
+	e, err := fileEntry(pth, buf, s.program(entry{}))
+	if err != nil {
+		return err
+	}
+	e.inp = ".load " + pth
+	out, err := s.eval(e)
+	fmt.Fprint(s.out, out)
+	return err
+}
+
+// zeroVersion is the version that a module is required at when it is replaced
+// by a directory.
+const zeroVersion = "v0.0.0-00010101000000-000000000000"
+
+// loadPkg imports the package in the directory dir. If it is not in a module
+// that programs are built with, its module is replaced by the directory of the
+// module, so that the package can be imported without publishing it. The
+// go.mod of a session with a File is the user's, so it is not changed.
+func (s *Session) loadPkg(dir string) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return fmt.Errorf("bad directory %q: %w", dir, err)
+	}
+	pkg, err := s.goTool(s.dir, "list", "-f", "{{.ImportPath}}", dir)
+	if err != nil && s.org != nil {
+		return fmt.Errorf("bad package %q: %w\n(igo does not change the "+
+			"go.mod of %s; add a replace directive with go mod edit)",
+			dir, err, s.pth)
+	} else if err != nil {
+		out, err := s.goTool(dir, "list", "-f",
+			"{{.ImportPath}}\t{{.Module.Path}}\t{{.Module.Dir}}", ".")
+		if err != nil {
+			return fmt.Errorf("bad package %q: %w", dir, err)
+		}
+		var mod, root string
+		pkg, out, _ = strings.Cut(out, "\t")
+		mod, root, _ = strings.Cut(out, "\t")
+		_, err = s.goTool(s.dir, "mod", "edit", "-replace", mod+"="+root)
+		if err != nil {
+			return fmt.Errorf("failed to replace %s: %w", mod, err)
+		}
+		if _, err := s.goTool(s.dir, "get", mod+"@"+zeroVersion); err != nil {
+			return fmt.Errorf("failed to get %s: %w", mod, err)
+		}
+	}
+	if _, err := s.goTool(s.dir, "build", pkg); err != nil {
+		return fmt.Errorf("failed to build %s:\n%w", pkg, err)
+	}
+	return s.importPkg(pkg)
+}
+
+// fileEntry returns an entry with the declarations and the body of main() from
+// the Go file named name with source src. Imports that base already has are
+// skipped.
+func fileEntry(name string, src, base []byte) (entry, error) {
+	fs := token.NewFileSet()
+	root, err := parser.ParseFile(fs, name, src, parser.ParseComments)
+	if err != nil {
+		return entry{}, fmt.Errorf("failed to parse: %w", err)
+	}
+	have := make(map[string]bool)
+	cur, err := parser.ParseFile(token.NewFileSet(), "", base,
+		parser.ImportsOnly)
+	if err == nil {
+		for _, spec := range cur.Imports {
+			have[importKey(spec)] = true
+		}
+	}
+	text := func(pos, end token.Pos) string {
+		return string(src[fs.Position(pos).Offset:fs.Position(end).Offset])
+	}
+	var e entry
+	for _, d := range root.Decls {
+		pos := d.Pos()
+		switch d := d.(type) {
+		case *ast.GenDecl:
+			if d.Tok == token.IMPORT {
+				for _, spec := range d.Specs {
+					spec := spec.(*ast.ImportSpec)
+					if !have[importKey(spec)] {
+						have[importKey(spec)] = true
+						e.imp += "import " + text(spec.Pos(), spec.End())
+						e.imp += "\n"
+					}
+				}
+				continue
+			}
+			if d.Doc != nil {
+				pos = d.Doc.Pos()
+			}
+		case *ast.FuncDecl:
+			if d.Recv == nil && d.Name.Name == "main" {
+				e.usr += text(d.Body.Lbrace+1, d.Body.Rbrace) + "\n"
+				continue
+			}
+			if d.Doc != nil {
+				pos = d.Doc.Pos()
+			}
+		}
+		e.pkg += text(pos, d.End()) + "\n"
+	}
+	return e, nil
+}
+
+// importKey identifies spec by its name and path.
+func importKey(spec *ast.ImportSpec) string {
+	if spec.Name == nil {
+		return spec.Path.Value
+	}
+	return spec.Name.Name + " " + spec.Path.Value
+}
+
+// Source returns the program that is built for the session, as .source prints
+// it: with the line directives, the marker, the uses of variables that are not
+// used, and the imports that goimports adds or that are blank.
+func (s *Session) Source() string {
+	var e entry
+	for _, name := range s.unu {
+		e.usr += "_ = " + name + "\n"
+	}
+	src := s.source(e)
+	buf, err := s.goimports(s.pth, src)
+	if err != nil {
+		return string(src)
+	}
+	buf = withImports(src, buf, s.pth)
+	return string(blankImports(buf, s.rmi))
+}
+
+// printSource prints the program that is run for the session. If num is set,
+// lines are numbered.
+func (s *Session) printSource(num bool) error {
+	lines := strings.SplitAfter(s.Source(), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	var b strings.Builder
+	for i, line := range lines {
+		if num {
+			fmt.Fprintf(&b, "%4d  ", i+1)
+		}
+		b.WriteString(line)
+	}
+	s.page(b.String())
+	return nil
+}
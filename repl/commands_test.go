@@ -0,0 +1,259 @@
+package repl
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestCp(t *testing.T) {
+	dir := t.TempDir()
+	pth := filepath.Join(dir, "main.go")
+	src := []byte("package main\n\nfunc main() {}\n")
+	if err := os.WriteFile(pth, src, 0644); err != nil {
+		t.Fatal(err)
+	}
+	other := filepath.Join(dir, "other.txt")
+	if err := os.WriteFile(other, []byte("keep"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(data, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSession(Options{File: pth, Stdout: io.Discard,
+		Stderr: io.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, arg := range []string{"go.mod", "go.sum", pth, other} {
+		if _, err := s.Command(".cp " + arg); err == nil {
+			t.Errorf(".cp %s: got no error", arg)
+		}
+	}
+	for range 2 {
+		if _, err := s.Command(".cp " + data); err != nil {
+			t.Fatalf(".cp %s: %v", data, err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "data.txt")); err == nil {
+		t.Error("copied file was not removed on Close")
+	}
+	if buf, err := os.ReadFile(other); err != nil || string(buf) != "keep" {
+		t.Errorf("other.txt = %q, %v, want %q", buf, err, "keep")
+	}
+	if buf, err := os.ReadFile(pth); err != nil || string(buf) != string(src) {
+		t.Errorf("main.go = %q, %v, want %q", buf, err, src)
+	}
+}
+
+func TestRestricted(t *testing.T) {
+	s, err := NewSession(Options{NoShell: true, NoFiles: true,
+		Stdout: io.Discard, Stderr: io.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	pth := filepath.Join(t.TempDir(), "x.go")
+	for _, input := range []string{
+		":echo hi", ".edit", ".capture out echo hi", ".copy",
+		".save " + pth, ".commit", ".load " + pth, ".reload", ".cp " + pth,
+		".cd /", ".get example.com/m", ".stdin " + pth, ".set get on",
+	} {
+		if ok, err := s.Command(input); !ok || err == nil {
+			t.Errorf("%s: got %v, %v, want an error", input, ok, err)
+		}
+	}
+	for _, input := range []string{
+		`.stdin "in"`, ".stdin -", ".set", ".set pager off", ".pwd",
+	} {
+		if _, err := s.Command(input); err != nil {
+			t.Errorf("%s: %v", input, err)
+		}
+	}
+	if _, err := os.Stat(pth); err == nil {
+		t.Error(".save wrote a file")
+	}
+}
+
+func TestReload(t *testing.T) {
+	pth := filepath.Join(t.TempDir(), "main.go")
+	src := "package main\n\nimport \"fmt\"\n\nfunc main() {\n" +
+		"\tfmt.Println(\"start\")\n}\n"
+	if err := os.WriteFile(pth, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	s, err := NewSession(Options{File: pth, Stdout: &out,
+		Stderr: io.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	eval(t, s, "start\nhello\n", "fmt.Println(\"hello\")")
+	if buf, err := os.ReadFile(pth); err != nil || string(buf) != src {
+		t.Fatalf("main.go = %q, %v, want %q", buf, err, src)
+	}
+	edited := strings.Replace(src, "start", "edited", 1)
+	if err := os.WriteFile(pth, []byte(edited), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Command(".reload"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.String(), "edited\nhello\n"; got != want {
+		t.Errorf(".reload printed %q, want %q", got, want)
+	}
+	eval(t, s, "bye\n", "fmt.Println(\"bye\")")
+	if _, err := s.Command(".reload!"); err != nil {
+		t.Fatal(err)
+	}
+	eval(t, s, "edited\n1\n", "1")
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := os.ReadFile(pth); err != nil || string(buf) != edited {
+		t.Errorf("main.go = %q, %v, want %q", buf, err, edited)
+	}
+}
+
+// standaloneInput is the input of the sessions that TestCommit and
+// TestStandalone keep, and standaloneMain is the main() that they keep.
+var standaloneInput = []string{"x := 2", "x * 3", "x + 1", "_ * 2"}
+
+const standaloneMain = `
+
+import "fmt"
+
+func main() {
+	fmt.Println("start")
+	x := 2
+	fmt.Println(x * 3)
+	res2_1 := x + 1
+	fmt.Println(res2_1)
+	fmt.Println(res2_1 * 2)
+}
+`
+
+// fileSession returns a session with a File in package pkg that prints start,
+// and the path of the file.
+func fileSession(t *testing.T, pkg string) (*Session, string) {
+	t.Helper()
+	pth := filepath.Join(t.TempDir(), "main.go")
+	src := "package " + pkg + "\n\nimport \"fmt\"\n\nfunc main() {\n" +
+		"\tfmt.Println(\"start\")\n}\n"
+	if err := os.WriteFile(pth, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSession(Options{File: pth, Stdout: io.Discard,
+		Stderr: io.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	for _, input := range standaloneInput {
+		if _, err := s.Eval(input); err != nil {
+			t.Fatalf("Eval(%q): %v", input, err)
+		}
+	}
+	return s, pth
+}
+
+func TestCommit(t *testing.T) {
+	s, pth := fileSession(t, "foo")
+	if _, err := s.Command(".commit"); err != nil {
+		t.Fatal(err)
+	}
+	want := "package foo" + standaloneMain
+	if buf, err := os.ReadFile(pth); err != nil || string(buf) != want {
+		t.Errorf("main.go = %q, %v, want %q", buf, err, want)
+	}
+}
+
+func TestStandalone(t *testing.T) {
+	s, _ := fileSession(t, "foo")
+	want := "package main" + standaloneMain
+	pth := filepath.Join(t.TempDir(), "saved.go")
+	if _, err := s.Command(".save " + pth); err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := os.ReadFile(pth); err != nil || string(buf) != want {
+		t.Errorf(".save wrote %q, %v, want %q", buf, err, want)
+	}
+	if runtime.GOOS == "windows" {
+		return
+	}
+	// A fake pbcopy receives what .copy copies.
+	bin := t.TempDir()
+	clip := filepath.Join(bin, "clipboard")
+	script := "#!/bin/sh\ncat > " + clip + "\n"
+	err := os.WriteFile(filepath.Join(bin, "pbcopy"), []byte(script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	if _, err := s.Command(".copy source"); err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := os.ReadFile(clip); err != nil || string(buf) != want {
+		t.Errorf(".copy source copied %q, %v, want %q", buf, err, want)
+	}
+}
+
+func TestSource(t *testing.T) {
+	s := newSession(t)
+	eval(t, s, "", "x := 1")
+	src := s.Source()
+	for _, want := range []string{"/*line ", "_igoEOF()", "_ = x"} {
+		if !strings.Contains(src, want) {
+			t.Errorf("Source() does not contain %q:\n%s", want, src)
+		}
+	}
+	// The program builds as it is printed.
+	pth := filepath.Join(s.Dir(), "main.go")
+	if err := os.WriteFile(pth, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("go", "build", "-o", os.DevNull, pth)
+	cmd.Dir = s.Dir()
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("go build: %v\n%s", err, out)
+	}
+}
+
+func TestRelativePaths(t *testing.T) {
+	s := newSession(t)
+	dir := t.TempDir()
+	files := map[string]string{
+		"in.txt": "hi",
+		"lib.go": "package main\n\nfunc double(x int) int { return 2 * x }\n",
+	}
+	for name, src := range files {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, cmd := range []string{
+		".cd " + dir, ".stdin in.txt", ".load lib.go", ".save out.go",
+	} {
+		if _, err := s.Command(cmd); err != nil {
+			t.Fatalf("%s: %v", cmd, err)
+		}
+	}
+	if string(s.inp) != "hi" {
+		t.Errorf("stdin = %q, want %q", s.inp, "hi")
+	}
+	eval(t, s, "4\n", "double(2)")
+	if _, err := os.Stat(filepath.Join(dir, "out.go")); err != nil {
+		t.Errorf(".save out.go: %v", err)
+	}
+}
@@ -0,0 +1,190 @@
+package repl
+
+import (
+	"cmp"
+	"go/token"
+	"go/types"
+	"os/exec"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// majorVersion matches the last element of an import path that is a major
+// version.
+var majorVersion = regexp.MustCompile(`^v[0-9]+$`)
+
+// stdPaths maps the names of standard library packages to their import paths.
+var stdPaths = sync.OnceValue(func() map[string][]string {
+	pkgs := make(map[string][]string)
+	out, err := exec.Command("go", "list", "std").Output()
+	if err != nil {
+		return pkgs
+	}
+	for pth := range strings.FieldsSeq(string(out)) {
+		if strings.Contains(pth, "internal") ||
+			strings.Contains(pth, "vendor") {
+			continue
+		}
+		name := pkgName(pth)
+		pkgs[name] = append(pkgs[name], pth)
+	}
+	return pkgs
+})
+
+// stdPkgs maps the names of standard library packages to their import paths.
+// If packages have the same name, the shortest path is preferred, e.g.
+// math/rand over math/rand/v2.
+var stdPkgs = sync.OnceValue(func() map[string]string {
+	pkgs := make(map[string]string)
+	for name, paths := range stdPaths() {
+		pkgs[name] = slices.MinFunc(paths, func(a, b string) int {
+			return cmp.Compare(len(a), len(b))
+		})
+	}
+	return pkgs
+})
+
+// pkgName returns the conventional name of the package at pth, which is its
+// last element, other than a major version such as v2.
+func pkgName(pth string) string {
+	dir, name := path.Split(pth)
+	if dir != "" && majorVersion.MatchString(name) {
+		name = path.Base(dir)
+	}
+	return name
+}
+
+// Complete returns the identifiers that complete the word at the end of head,
+// along with the part of the word that has already been typed.
+//
+// The word is completed against the session's committed code, so completions
+// work even if head itself is incomplete or invalid.
+func (s *Session) Complete(head string) (string, []string) {
+	i := len(head)
+	for i > 0 {
+		r, size := utf8.DecodeLastRuneInString(head[:i])
+		if r != '.' && r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			break
+		}
+		i -= size
+	}
+	word := head[i:]
+	qual, part := "", word
+	if j := strings.LastIndex(word, "."); j >= 0 {
+		qual, part = word[:j], word[j+1:]
+	}
+	c, err := s.check(s.source(entry{}))
+	if err != nil {
+		return part, nil
+	}
+	fn := c.main()
+	if fn == nil {
+		return part, nil
+	}
+	var names []string
+	scope := c.pkg.Types.Scope().Innermost(fn.Body.Rbrace)
+	if qual == "" {
+		for ; scope != nil; scope = scope.Parent() {
+			names = append(names, scope.Names()...)
+		}
+	} else if names = c.pkgMembers(scope, qual); names == nil {
+		names = c.members(fn.Body.Rbrace, qual)
+	}
+	var cands []string
+	for _, name := range names {
+		if strings.HasPrefix(name, part) && name != "_" &&
+			!strings.HasPrefix(name, "_igo") {
+			cands = append(cands, name)
+		}
+	}
+	slices.Sort(cands)
+	return part, slices.Compact(cands)
+}
+
+// pkgMembers returns the exported identifiers of the package named name, or
+// nil if name does not refer to a package. Packages that are not yet imported
+// are looked up in the standard library.
+func (c *checked) pkgMembers(scope *types.Scope, name string) []string {
+	var pkg *types.Package
+	if _, obj := scope.LookupParent(name, token.NoPos); obj != nil {
+		pn, ok := obj.(*types.PkgName)
+		if !ok {
+			return nil
+		}
+		pkg = pn.Imported()
+	} else if pth, ok := stdPkgs()[name]; ok {
+		pkgs, err := packages.Load(&packages.Config{
+			Mode: packages.NeedName | packages.NeedTypes,
+		}, pth)
+		if err != nil || len(pkgs) != 1 || pkgs[0].Types == nil {
+			return nil
+		}
+		pkg = pkgs[0].Types
+	} else {
+		return nil
+	}
+	var names []string
+	for _, name := range pkg.Scope().Names() {
+		if token.IsExported(name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// members returns the fields and methods of the value of expr.
+func (c *checked) members(pos token.Pos, expr string) []string {
+	tv, err := types.Eval(c.pkg.Fset, c.pkg.Types, pos, expr)
+	if err != nil || tv.Type == nil {
+		return nil
+	}
+	var names []string
+	visible := func(obj types.Object) bool {
+		return obj.Exported() || obj.Pkg() == c.pkg.Types
+	}
+	t := tv.Type
+	if _, ok := t.Underlying().(*types.Interface); !ok && !tv.IsType() {
+		if _, ok := t.(*types.Pointer); !ok {
+			t = types.NewPointer(t)
+		}
+	}
+	ms := types.NewMethodSet(t)
+	for i := range ms.Len() {
+		if obj := ms.At(i).Obj(); visible(obj) {
+			names = append(names, obj.Name())
+		}
+	}
+	if tv.IsType() {
+		return names
+	}
+	seen := make(map[types.Type]bool)
+	var fields func(t types.Type)
+	fields = func(t types.Type) {
+		if p, ok := t.Underlying().(*types.Pointer); ok {
+			t = p.Elem()
+		}
+		st, ok := t.Underlying().(*types.Struct)
+		if !ok || seen[t] {
+			return
+		}
+		seen[t] = true
+		for i := range st.NumFields() {
+			f := st.Field(i)
+			if visible(f) {
+				names = append(names, f.Name())
+			}
+			if f.Embedded() {
+				fields(f.Type())
+			}
+		}
+	}
+	fields(tv.Type)
+	return names
+}
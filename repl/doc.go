@@ -0,0 +1,109 @@
+package repl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/google/shlex"
+	"golang.org/x/term"
+)
+
+// doc prints the documentation of name. Declarations in the session are
+// documented from their doc comments, and anything else is documented by go
+// doc, as resolved in the session's module.
+func (s *Session) doc(name string) error {
+	if name == "" {
+		return errors.New("usage: .doc SYMBOL")
+	}
+	if d, ok := s.findDecl(name); ok {
+		s.page(d.doc())
+		return nil
+	}
+	cmd := exec.Command("go", "doc", name)
+	cmd.Dir = s.dir
+	out, err := cmd.CombinedOutput()
+	if ee := new(exec.ExitError); errors.As(err, &ee) {
+		return errors.New(string(bytes.TrimSpace(out)))
+	} else if err != nil {
+		return fmt.Errorf("failed to run go doc: %w", err)
+	}
+	s.page(string(out))
+	return nil
+}
+
+// doc returns the documentation of d in the format of go doc: its declaration,
+// without the body of a function, followed by its indented doc comment.
+func (d decl) doc() string {
+	var b strings.Builder
+	var node ast.Node
+	switch d := d.Decl.(type) {
+	case *ast.FuncDecl:
+		sig := *d
+		sig.Doc, sig.Body = nil, nil
+		node = &sig
+	case *ast.GenDecl:
+		gen := *d
+		gen.Doc = nil
+		node = &gen
+	}
+	if err := format.Node(&b, d.fs, node); err != nil {
+		return ""
+	}
+	b.WriteString("\n")
+	if doc := declDoc(d.Decl); doc != nil {
+		for line := range strings.Lines(doc.Text()) {
+			if line != "\n" {
+				b.WriteString("    ")
+			}
+			b.WriteString(line)
+		}
+	}
+	return b.String()
+}
+
+// Page prints text to Stdout, through $PAGER, falling back to less -FRX, if
+// Stdout, or the Terminal that it prints to, is a terminal that text does not
+// fit in and the session pages output. Otherwise, it prints text as it is.
+func (s *Session) Page(text string) {
+	s.page(text)
+}
+
+// page prints text like Page.
+func (s *Session) page(text string) {
+	f := s.trm
+	if f == nil || !s.pag {
+		fmt.Fprint(s.out, text)
+		return
+	}
+	fd := int(f.Fd())
+	_, height, err := term.GetSize(fd)
+	if err != nil || !term.IsTerminal(fd) ||
+		strings.Count(text, "\n") < height {
+		fmt.Fprint(s.out, text)
+		return
+	}
+	pager := os.Getenv("PAGER")
+	if pager == "" {
+		// Colors are kept, and the screen is not cleared.
+		pager = "less -FRX"
+	}
+	argv, err := shlex.Split(pager)
+	if err != nil || len(argv) == 0 {
+		fmt.Fprint(s.out, text)
+		return
+	}
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stdin = strings.NewReader(text)
+	cmd.Stdout, cmd.Stderr = f, os.Stderr
+	if err := cmd.Run(); err != nil {
+		fmt.Fprint(s.out, text)
+		return
+	}
+	fmt.Fprint(s.tsc, text)
+}
@@ -0,0 +1,196 @@
+package repl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"os"
+	"os/exec"
+	"slices"
+
+	"github.com/google/shlex"
+)
+
+// edit opens the session's code in an editor and runs the edited code in its
+// place. If name is set, only the declaration of name is edited. If the editor
+// fails or the code is left unchanged, the session is left as is.
+func (s *Session) edit(name string) error {
+	if name != "" {
+		return s.editDecl(name)
+	}
+	var b bytes.Buffer
+	b.WriteString("package main\n\n")
+	for _, e := range s.usr {
+		b.WriteString(e.imp)
+	}
+	b.WriteString("\n")
+	for _, e := range s.usr {
+		b.WriteString(e.pkg)
+	}
+	b.WriteString("\nfunc main() {\n")
+	for _, e := range s.usr {
+		b.WriteString(e.usr)
+	}
+	b.WriteString("}\n")
+	src := b.Bytes()
+	if buf, err := format.Source(src); err == nil {
+		src = buf
+	}
+	buf, err := editText(src)
+	if err != nil || bytes.Equal(buf, src) {
+		return err
+	}
+	e, err := fileEntry("main.go", buf, s.src)
+	if err != nil {
+		return err
+	}
+	return s.replace([]entry{e})
+}
+
+// editDecl opens the last package-level declaration of name in an editor and
+// runs the session again with the edited declaration in its place. Methods are
+// named by their receiver type and method name, e.g. T.String.
+func (s *Session) editDecl(name string) error {
+	d, ok := s.findDecl(name)
+	if !ok {
+		return fmt.Errorf("no declaration of %s", name)
+	}
+	e := s.usr[d.idx]
+	src := []byte(e.pkg[d.start:d.end])
+	buf, err := editText(src)
+	if err != nil || bytes.Equal(buf, src) {
+		return err
+	}
+	usr := slices.Clone(s.usr)
+	usr[d.idx].pkg = e.pkg[:d.start] + string(buf) + e.pkg[d.end:]
+	return s.replace(usr)
+}
+
+// A decl is a package-level declaration in the session.
+type decl struct {
+	ast.Decl
+	fs    *token.FileSet
+	idx   int // Index of its entry in the session.
+	start int // Offset to its start in the entry, including its doc comment.
+	end   int // Offset to its end in the entry.
+}
+
+// findDecl returns the last package-level declaration of name in the session.
+// Methods are named by their receiver type and method name, e.g. T.String.
+func (s *Session) findDecl(name string) (decl, bool) {
+	const prefix = "package main\n"
+	for i, e := range slices.Backward(s.usr) {
+		fs := token.NewFileSet()
+		root, err := parser.ParseFile(fs, "", prefix+e.pkg,
+			parser.ParseComments)
+		if err != nil {
+			continue
+		}
+		for _, d := range slices.Backward(root.Decls) {
+			if declName(d) != name {
+				continue
+			}
+			pos := d.Pos()
+			if doc := declDoc(d); doc != nil {
+				pos = doc.Pos()
+			}
+			return decl{
+				Decl:  d,
+				fs:    fs,
+				idx:   i,
+				start: fs.Position(pos).Offset - len(prefix),
+				end:   fs.Position(d.End()).Offset - len(prefix),
+			}, true
+		}
+	}
+	return decl{}, false
+}
+
+// declName returns the name of a function, method, or type declaration.
+func declName(d ast.Decl) string {
+	switch d := d.(type) {
+	case *ast.FuncDecl:
+		if d.Recv == nil || len(d.Recv.List) == 0 {
+			return d.Name.Name
+		}
+		typ := d.Recv.List[0].Type
+		for {
+			switch t := typ.(type) {
+			case *ast.StarExpr:
+				typ = t.X
+				continue
+			case *ast.IndexExpr:
+				typ = t.X
+				continue
+			case *ast.IndexListExpr:
+				typ = t.X
+				continue
+			case *ast.Ident:
+				return t.Name + "." + d.Name.Name
+			}
+			return d.Name.Name
+		}
+	case *ast.GenDecl:
+		if len(d.Specs) == 1 {
+			if spec, ok := d.Specs[0].(*ast.TypeSpec); ok {
+				return spec.Name.Name
+			}
+		}
+	}
+	return ""
+}
+
+// declDoc returns the doc comment of a declaration, if any.
+func declDoc(d ast.Decl) *ast.CommentGroup {
+	switch d := d.(type) {
+	case *ast.FuncDecl:
+		return d.Doc
+	case *ast.GenDecl:
+		return d.Doc
+	}
+	return nil
+}
+
+// editText opens src in $EDITOR, falling back to vi or nano, and returns the
+// edited text.
+func editText(src []byte) ([]byte, error) {
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		for _, name := range []string{"vi", "nano"} {
+			if _, err := exec.LookPath(name); err == nil {
+				editor = name
+				break
+			}
+		}
+	}
+	argv, err := shlex.Split(editor)
+	if err != nil || len(argv) == 0 {
+		return nil, errors.New("no editor found; set $EDITOR")
+	}
+	f, err := os.CreateTemp("", "igo*.go")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(src); err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("failed to write file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write file: %w", err)
+	}
+	cmd := exec.Command(argv[0], append(argv[1:], f.Name())...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("editor failed: %w", err)
+	}
+	buf, err := os.ReadFile(f.Name())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	return buf, nil
+}
@@ -0,0 +1,19 @@
+//go:build unix
+
+package repl
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setGroup makes cmd start in a new process group, so that it can be killed
+// along with its children.
+func setGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killGroup kills the process group of cmd.
+func killGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
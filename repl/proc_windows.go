@@ -0,0 +1,23 @@
+//go:build windows
+
+package repl
+
+import (
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// setGroup makes cmd start in a new process group, so that it can be killed
+// along with its children.
+func setGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP,
+	}
+}
+
+// killGroup kills cmd and its children.
+func killGroup(cmd *exec.Cmd) error {
+	pid := strconv.Itoa(cmd.Process.Pid)
+	return exec.Command("taskkill", "/t", "/f", "/pid", pid).Run()
+}
@@ -0,0 +1,2258 @@
+// Package repl implements a Go read-eval-print loop.
+//
+// It is a hack. It works by appending each input to a Go program and rerunning
+// it, then hiding the repeated output.
+package repl
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/format"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"go/types"
+	"go/version"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/tools/go/packages"
+	"golang.org/x/tools/imports"
+)
+
+var builderr = regexp.MustCompile(`^(\S*?[^\s:]):(\d+):(\d+):\s*(.+)$`)
+var unusedimp = regexp.MustCompile(`^(".+") imported (as \S+ )?and not used$`)
+var nomodule = regexp.MustCompile(`no required module provides package (\S+);`)
+var mismatch = regexp.MustCompile(`^assignment mismatch: .* (\d+) values?$`)
+var inputpos = regexp.MustCompile(`(?m)^([\t ]*)(?:\S*[/\\])?input:(\d+)`)
+var resultvar = regexp.MustCompile(`^_(\d*)$`)
+var igoresult = regexp.MustCompile(`\b_igo(\d+_\d+)\b`)
+var mainframe = regexp.MustCompile(`(?m)^main\.main\(\)\n\tinput (\d+)`)
+
+// ErrIncomplete is returned by Eval if the input is incomplete, such as an
+// unclosed brace, and continues on the next line.
+var ErrIncomplete = errors.New("incomplete input")
+
+// ErrTimeout is returned by Eval if the input runs for longer than the
+// session's timeout.
+var ErrTimeout = errors.New("execution timed out")
+
+// ErrInterrupt is returned by Eval if the session is interrupted.
+var ErrInterrupt = errors.New("interrupt")
+
+const unused = "declared and not used: "
+const novalue = "(no value) used as value"
+const foundEOF = "found 'EOF'"
+const embed = "//go:embed"
+
+// exitHint explains why input that calls os.Exit is not added to the session.
+const exitHint = "(os.Exit would stop every run that follows, " +
+	"so the input is not kept)"
+
+// helpers are functions for printing that the session declares, unless the
+// program declares functions of the same names: p prints its arguments like
+// fmt.Println, and pp prints each of them on its own line with %#v.
+var helpers = []struct{ name, code string }{
+	{"p", `
+func p(a ...any) {
+	fmt.Println(a...)
+}
+`},
+	{"pp", `
+func pp(a ...any) {
+	for _, v := range a {
+		fmt.Printf("%#v\n", v)
+	}
+}
+`},
+}
+
+// printFunc prints the values of expressions, after %[1]s and before %[2]s,
+// which set their color, if any. Struct fields are printed with their names.
+// It is a variable so that it can be replaced.
+const printFunc = `
+var _igoPrint = func(vals ...any) {
+%[1]s	for i, v := range vals {
+		if i > 0 {
+			fmt.Print(" ")
+		}
+		fmt.Printf("%%+v", %[3]s)
+	}
+%[2]s	fmt.Println()
+}
+`
+
+// truncFuncs format values like %+v, except that slices, arrays, and maps
+// longer than %[1]d+%[2]d elements are printed with only their first %[1]d and
+// last %[2]d, and that values nested more than %[3]d deep are elided. They do
+// not use cmp, which programs may import from another module, e.g. go-cmp, and
+// they use the packages they need under the names of truncImports, so that
+// they do not depend on the imports of the session.
+const truncFuncs = `
+func _igoTrunc(v any) string {
+	return _igoFormat(_igoreflect.ValueOf(v), 0)
+}
+
+func _igoFormat(v _igoreflect.Value, depth int) string {
+	if !v.IsValid() {
+		return "<nil>"
+	}
+	if v.CanInterface() {
+		switch v.Interface().(type) {
+		case _igofmt.Formatter, _igofmt.Stringer, error:
+			return _igofmt.Sprintf("%%+v", v.Interface())
+		}
+	}
+	if depth > %[3]d {
+		return "..."
+	}
+	switch v.Kind() {
+	case _igoreflect.Array, _igoreflect.Slice:
+		return "[" + _igoJoin(v.Len(), func(i int) string {
+			return _igoFormat(v.Index(i), depth+1)
+		}) + "]"
+	case _igoreflect.Map:
+		keys := v.MapKeys()
+		_igoslices.SortFunc(keys, _igoCompare)
+		return "map[" + _igoJoin(len(keys), func(i int) string {
+			return _igoFormat(keys[i], depth+1) + ":" +
+				_igoFormat(v.MapIndex(keys[i]), depth+1)
+		}) + "]"
+	case _igoreflect.Struct:
+		var b _igostrings.Builder
+		for i := 0; i < v.NumField(); i++ {
+			if i > 0 {
+				b.WriteString(" ")
+			}
+			b.WriteString(v.Type().Field(i).Name + ":" +
+				_igoFormat(v.Field(i), depth+1))
+		}
+		return "{" + b.String() + "}"
+	case _igoreflect.Pointer:
+		if depth > 0 || v.IsNil() {
+			break
+		}
+		switch v.Elem().Kind() {
+		case _igoreflect.Array, _igoreflect.Slice, _igoreflect.Map,
+			_igoreflect.Struct:
+			return "&" + _igoFormat(v.Elem(), depth+1)
+		}
+	case _igoreflect.Interface:
+		return _igoFormat(v.Elem(), depth)
+	}
+	return _igofmt.Sprintf("%%+v", v)
+}
+
+func _igoJoin(n int, elem func(i int) string) string {
+	var b _igostrings.Builder
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			b.WriteString(" ")
+		}
+		if i == %[1]d && n > %[1]d+%[2]d {
+			_igofmt.Fprintf(&b, "... %%d more ...", n-%[1]d-%[2]d)
+			i = n - %[2]d - 1
+			continue
+		}
+		b.WriteString(elem(i))
+	}
+	return b.String()
+}
+
+func _igoCompare(a, b _igoreflect.Value) int {
+	switch {
+	case a.CanInt():
+		return _igoOrder(a.Int(), b.Int())
+	case a.CanUint():
+		return _igoOrder(a.Uint(), b.Uint())
+	case a.CanFloat():
+		return _igoOrder(a.Float(), b.Float())
+	case a.Kind() == _igoreflect.String:
+		return _igoOrder(a.String(), b.String())
+	}
+	return _igoOrder(_igofmt.Sprint(a), _igofmt.Sprint(b))
+}
+
+func _igoOrder[T int64 | uint64 | float64 | string](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+`
+
+// truncImports are the imports of truncFuncs. They are declared one by one,
+// like the other imports of the program, since goimports misplaces the comments
+// that follow a grouped import when it merges them, such as //go:embed.
+const truncImports = `import _igofmt "fmt"
+import _igoreflect "reflect"
+import _igoslices "slices"
+import _igostrings "strings"
+`
+
+// truncHead, truncTail, and truncDepth are the numbers of elements that are
+// printed at the start and the end of long collections, and the depth of
+// values that is printed, unless truncation is turned off.
+const (
+	truncHead  = 20
+	truncTail  = 5
+	truncDepth = 10
+)
+
+// nowFunc replaces time.Now in deterministic mode, returning the time %d, in
+// nanoseconds since the Unix epoch.
+const nowFunc = `
+func _igoNow() time.Time { return time.Unix(0, %d) }
+`
+
+// resultColor and resetColor are the ANSI escape codes that set the color of
+// values and reset it.
+const (
+	resultColor = "\x1b[36m"
+	resetColor  = "\x1b[0m"
+)
+
+// eofFunc prints the marker %[1]q that follows the output of the session, to
+// both standard output and standard error, and the marker that follows the
+// values of the watches, which are printed after it.
+const eofFunc = `
+func _igoEOF() {
+	os.Stdout.WriteString(%[1]q + "\n")
+	os.Stderr.WriteString(%[1]q + "\n")
+}
+
+func _igoWatched() {
+	os.Stdout.WriteString(%[1]q + %[2]q)
+}
+`
+
+// watchedMarker follows the session's marker in the marker that ends the
+// values of the watches.
+const watchedMarker = " watched\n"
+
+// watchStmt prints the value of watch %[3]d, %[2]s, after %[1]q. A panic is
+// printed as its value, so that the input still runs, and errors refer to the
+// number of the watch, in %[4]s.
+const watchStmt = `func() {
+	defer func() {
+		if r := recover(); r != nil {
+			_igoPrint("panic:", r)
+		}
+	}()
+	fmt.Print(%[1]q)
+	_igoPrint(/*line %[4]s:%[3]d:1*/ %[2]s,
+	)
+}()
+`
+
+// An entry is a piece of user code that has been evaluated.
+type entry struct {
+	inp string   // Input as typed, if any.
+	imp string   // Import declarations.
+	pkg string   // Package-level declarations.
+	usr string   // Statements in main().
+	lns int      // Number of input lines.
+	out int      // Number of lines printed.
+	err int      // Number of lines of error output printed.
+	val []string // Variables holding results, if any.
+	dcl []string // Variables declared, in stateful mode, e.g. "x int".
+	red []string // Variables redeclared, in a new block.
+}
+
+// A buildError is the output of a failed build of src.
+type buildError struct {
+	out string
+	src []byte
+}
+
+// Error returns the output with positions that refer to input lines rewritten,
+// and with the source line and column of each compile error.
+func (e buildError) Error() string {
+	var b strings.Builder
+	for i, line := range strings.Split(e.out, "\n") {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		b.WriteString(inputLines(line))
+		m := builderr.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		ln, _ := strconv.Atoi(m[2])
+		col, _ := strconv.Atoi(m[3])
+		if text, caret, ok := sourceLine(e.src, m[1], ln, col); ok {
+			b.WriteString("\n\t" + text + "\n\t" + caret)
+		}
+	}
+	return b.String()
+}
+
+// sourceLine returns the line of src at position name:line:col, as adjusted
+// by line directives, and a caret under the column. Line directives and
+// leading spaces are omitted.
+func sourceLine(src []byte, name string, line, col int) (string, string, bool) {
+	// go build prints paths relative to the working directory, if shorter.
+	name = strings.TrimLeft(filepath.ToSlash(name), "./")
+	fs := token.NewFileSet()
+	file := fs.AddFile("", -1, len(src))
+	var sc scanner.Scanner
+	sc.Init(file, src, nil, 0)
+	// The position is in the last token on the line that starts at or before
+	// the column.
+	off := -1
+	for {
+		pos, tok, _ := sc.Scan()
+		if tok == token.EOF {
+			break
+		}
+		p := file.PositionFor(pos, true)
+		pth := filepath.ToSlash(p.Filename)
+		if p.Line == line && p.Column <= col && (pth == name ||
+			strings.HasSuffix(pth, "/"+name)) {
+			off = file.Offset(pos) + col - p.Column
+		}
+	}
+	if off < 0 || off > len(src) {
+		return "", "", false
+	}
+	start := bytes.LastIndexByte(src[:off], '\n') + 1
+	end := len(src)
+	if i := bytes.IndexByte(src[off:], '\n'); i >= 0 {
+		end = off + i
+	}
+	if off < start {
+		return "", "", false
+	}
+	// Start after the line directive that the position follows, if any.
+	if i := bytes.LastIndex(src[start:off], []byte("*/")); i >= 0 &&
+		bytes.Contains(src[start:start+i], []byte("/*line ")) {
+		start += i + len("*/")
+	}
+	for start < off && (src[start] == ' ' || src[start] == '\t') {
+		start++
+	}
+	var caret strings.Builder
+	for _, c := range src[start:off] {
+		if c == '\t' {
+			caret.WriteByte('\t')
+		} else {
+			caret.WriteByte(' ')
+		}
+	}
+	caret.WriteByte('^')
+	return string(src[start:end]), caret.String(), true
+}
+
+// inputLines rewrites positions in output that refer to input lines, such as
+// ./input:3:9 in compile errors and /path/to/input:3 in stack traces, as
+// input 3:9 and input 3.
+func inputLines(output string) string {
+	return inputpos.ReplaceAllString(output, "${1}input $2")
+}
+
+// Options configure a Session.
+type Options struct {
+	// File is the Go file that the session appends to. If it is empty, the
+	// session starts from an empty package main in a temporary module.
+	File string
+	// Module is the directory of a Go module whose packages a session without
+	// a File can import. The temporary module is in a workspace with it.
+	Module string
+	// CacheDir is the directory of the module of a session without a File,
+	// instead of a temporary one, so that it persists between sessions. It is
+	// created if needed, and a module that is already in it is used.
+	CacheDir string
+	// GoVersion, if set, is the go version, e.g. 1.22, that the go.mod of a
+	// session without a File declares, which is the language version of its
+	// programs. With GOTOOLCHAIN=auto, a newer version selects its toolchain.
+	GoVersion string
+	// Stateful makes the session restore the variables of main() from the
+	// last run, instead of running earlier input again.
+	Stateful bool
+	// Dir is the working directory of programs and shell commands. If it is
+	// empty, they run in the directory that programs are built in.
+	Dir string
+	// Timeout limits how long each input runs, unless it is 0.
+	Timeout time.Duration
+	// Get makes the session run go get for missing modules.
+	Get bool
+	// Race builds programs with the race detector.
+	Race bool
+	// Strict reports variables that are not used as errors, instead of
+	// using them.
+	Strict bool
+	// BuildFlags are passed to go build, e.g. -tags or -gcflags.
+	BuildFlags []string
+	// Keep keeps the temporary module of a session without a File when the
+	// session is closed.
+	Keep bool
+	// Choose picks the package to import for name from paths, which are
+	// packages of the standard library with that name and the members that
+	// the program uses, starting with the one that goimports chose. If it
+	// returns "", the first is imported. If Choose is nil, the first is
+	// imported with a warning. The choice is kept for the session.
+	Choose func(name string, paths []string) string
+	// Deterministic makes programs print the same output each time they run:
+	// the functions of math/rand are seeded with the same value, and time.Now
+	// returns the time that the session started.
+	Deterministic bool
+	// NoPager prints long output as it is, rather than through $PAGER.
+	NoPager bool
+	// NoShell disables the commands that run programs of the host: shell
+	// commands after a colon, .capture, .edit, and .copy.
+	NoShell bool
+	// NoFiles disables the commands that read or write files of the host or
+	// get modules: .save, .commit, .load, .reload, .cp, .cd, .get, .stdin
+	// with a file, and .set get.
+	NoFiles bool
+	// Color prints the values of expressions in color, with ANSI escape
+	// codes.
+	Color bool
+	// Stdin is read in full when the session starts, and is the standard
+	// input of every run. Programs have no standard input if it is nil.
+	Stdin io.Reader
+	// Sandbox builds programs for WASI and runs them with wasmtime or
+	// wazero, so that they cannot access the file system or the network.
+	// Only the environment variables that the session sets are passed to
+	// them. It cannot be used with Stateful.
+	Sandbox bool
+	// Progress, if set, shows an indicator while a program takes longer than
+	// progressDelay to build, which is erased before output is printed. It
+	// should be a terminal.
+	Progress io.Writer
+	// Stdout and Stderr receive the output of commands and the error output
+	// of programs. They default to os.Stdout and os.Stderr.
+	Stdout io.Writer
+	Stderr io.Writer
+	// Terminal is the terminal that Stdout prints to, if Stdout is not the
+	// terminal itself, e.g. when it also writes a transcript. Long output is
+	// paged on it.
+	Terminal *os.File
+	// Transcript receives the output that is paged on Terminal, which does
+	// not go through Stdout.
+	Transcript io.Writer
+}
+
+// A Session evaluates Go code by appending it to a program and running it.
+type Session struct {
+	dir string        // Working directory of builds.
+	cwd string        // Working directory of programs and shell commands.
+	tmp string        // Temporary directory.
+	kep bool          // Whether to keep the temporary module.
+	pth string        // Path to source file.
+	org []byte        // Source code of the file when it was read, if any.
+	cpd []string      // Files copied next to the original source, if any.
+	src []byte        // Source code.
+	imp int           // Offset to the end of the package clause.
+	top int           // Offset to the start of main().
+	bod int           // Offset to the body of main().
+	off int           // Offset to the last bracket of main().
+	frm int           // Last printed line.
+	efm int           // Last printed line of error output.
+	usr []entry       // User code.
+	rem string        // Output after the marker in the last run.
+	lst string        // Output of the last entry.
+	erm string        // Error output after the marker in the last run.
+	res int           // Number of results evaluated.
+	val []string      // Variables holding the last results.
+	lim time.Duration // Time limit for each run, if any.
+	get bool          // Whether to get missing modules.
+	rac bool          // Whether to build with the race detector.
+	flg []string      // Build flags.
+	fix bool          // Whether to use variables that are not used.
+	unu []string      // Variables that were not used in the last run.
+	bld time.Duration // Time spent building, for .time.
+	exe time.Duration // Time spent running, for .time.
+	chk bool          // Whether to build input without running it.
+	gos string        // GOOS of checks, if not the host's.
+	gar string        // GOARCH of checks, if not the host's.
+	col bool          // Whether to print values in color.
+	aut bool          // Whether to print the values of expressions.
+	hlp bool          // Whether to declare helpers.
+	trn bool          // Whether to truncate long collections in values.
+	wat []string      // Expressions that are printed after each input.
+	won bool          // Whether runs print the watches, after the marker.
+	trc bool          // Whether to print each program before it is built.
+	shw bool          // Whether to warn of shadowed builtins and packages.
+	pag bool          // Whether to page long output.
+	shl bool          // Whether commands can run programs of the host.
+	fil bool          // Whether commands can access files of the host.
+	bar bool          // Whether to assemble programs without _igoPrint.
+	det bool          // Whether programs are deterministic.
+	now int64         // Time that time.Now returns, if deterministic.
+	sig chan struct{} // Interrupts received.
+	eof string        // Marker printed after the output of the session.
+	bin string        // Path to compiled program.
+	sum [32]byte      // Hash of the source of the compiled program.
+	sta string        // Path to state file, in stateful mode.
+	ran int           // Number of entries that have run, in stateful mode.
+	inp []byte        // Standard input of programs, if any.
+	xit int           // Exit status of the last run.
+	env []string      // Environment overlay, of KEY=VALUE or KEY to unset.
+	arg []string      // Arguments of programs.
+	rmi []string      // Quoted paths of imports that are removed.
+	pin []string      // Quoted paths of imports that were chosen.
+	wrt *wasmRuntime  // Runtime of sandboxed programs, if any.
+	prg io.Writer     // Progress indicator, if any.
+	out io.Writer     // Output of commands.
+	trm *os.File      // Terminal that output is paged on, if any.
+	tsc io.Writer     // Transcript of the output that is paged.
+	err io.Writer     // Error output of programs.
+
+	// Chooses the package to import from packages with the same name.
+	cho func(name string, paths []string) string
+
+	// Checkpoints of the session, by name.
+	cps map[string]checkpoint
+}
+
+// NewSession returns a new session. It must be closed with Close.
+func NewSession(opts Options) (*Session, error) {
+	s := &Session{
+		lim: opts.Timeout,
+		get: opts.Get,
+		rac: opts.Race,
+		flg: opts.BuildFlags,
+		fix: !opts.Strict,
+		cho: opts.Choose,
+		col: opts.Color,
+		aut: true,
+		hlp: true,
+		trn: true,
+		shw: true,
+		pag: !opts.NoPager,
+		shl: !opts.NoShell,
+		fil: !opts.NoFiles,
+		det: opts.Deterministic,
+		now: time.Now().UnixNano(),
+		sig: make(chan struct{}, 1),
+		// The marker is random so that programs do not print it by chance.
+		eof: "\000igo:" + rand.Text(),
+		out: cmp.Or[io.Writer](opts.Stdout, os.Stdout),
+		err: cmp.Or[io.Writer](opts.Stderr, os.Stderr),
+		prg: opts.Progress,
+		trm: opts.Terminal,
+		tsc: cmp.Or[io.Writer](opts.Transcript, io.Discard),
+	}
+	if f, ok := s.out.(*os.File); ok && s.trm == nil {
+		s.trm = f
+	}
+	if opts.GoVersion != "" {
+		lang := version.Lang("go" + opts.GoVersion)
+		if lang == "" {
+			return nil, fmt.Errorf("bad go version %q", opts.GoVersion)
+		}
+		// Programs are built as files, whose language version is that of
+		// the toolchain rather than that of go.mod.
+		s.flg = append([]string{"-gcflags=-lang=" + lang}, s.flg...)
+	}
+	var err error
+	if opts.Stdin != nil {
+		if s.inp, err = io.ReadAll(opts.Stdin); err != nil {
+			return nil, fmt.Errorf("failed to read stdin: %w", err)
+		}
+	}
+	s.tmp, err = os.MkdirTemp("", "igo")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	s.bin = filepath.Join(s.tmp, "main")
+	if runtime.GOOS == "windows" {
+		s.bin += ".exe"
+	}
+	if opts.Stateful {
+		s.sta = filepath.Join(s.tmp, "state")
+	}
+	if opts.Sandbox {
+		if opts.Stateful {
+			_ = os.RemoveAll(s.tmp)
+			return nil, errors.New("stateful sessions cannot be sandboxed")
+		}
+		if s.wrt, err = findRuntime(); err != nil {
+			_ = os.RemoveAll(s.tmp)
+			return nil, err
+		}
+		s.bin = filepath.Join(s.tmp, "main.wasm")
+	}
+	if opts.File == "" {
+		mod := cmp.Or(opts.CacheDir, s.tmp)
+		if err := initModule(mod, opts.GoVersion); err != nil {
+			_ = os.RemoveAll(s.tmp)
+			return nil, err
+		}
+		if opts.Module != "" {
+			if err := workspace(mod, opts.Module); err != nil {
+				_ = os.RemoveAll(s.tmp)
+				return nil, err
+			}
+		}
+		s.pth = filepath.Join(mod, "main.go")
+		s.dir = mod
+		s.kep = opts.Keep
+	} else {
+		s.pth = opts.File
+		s.org, err = os.ReadFile(s.pth)
+		if err != nil {
+			_ = os.RemoveAll(s.tmp)
+			return nil, fmt.Errorf("bad file %q: %w", s.pth, err)
+		}
+	}
+	s.cwd = s.dir
+	if opts.Dir != "" {
+		// Dir is relative to the current directory.
+		s.cwd = ""
+		if err := s.cd(opts.Dir); err != nil {
+			_ = s.Close()
+			return nil, err
+		}
+	}
+	if err := s.Reset(); err != nil {
+		_ = s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// initModule makes dir a module for sessions without a File, creating it if
+// needed. A module that is already in dir is kept. If ver is set, go.mod
+// declares it as the go version.
+func initModule(dir, ver string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	var cmds [][]string
+	if _, err := os.Stat(filepath.Join(dir, "go.mod")); err != nil {
+		cmds = append(cmds, []string{"mod", "init", "igo.localhost"})
+	}
+	if ver != "" {
+		cmds = append(cmds, []string{"mod", "edit", "-go=" + ver})
+	}
+	for _, args := range cmds {
+		cmd := exec.Command("go", args...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf(`failed to run "go %s": %s`,
+				strings.Join(args[:2], " "), bytes.TrimSpace(out))
+		}
+	}
+	return nil
+}
+
+// workspace puts the module in dir in a workspace with the module at pth. If
+// dir already has a workspace, the module at pth is added to it.
+func workspace(dir, pth string) error {
+	pth, err := filepath.Abs(pth)
+	if err != nil {
+		return fmt.Errorf("bad module %q: %w", pth, err)
+	}
+	args := []string{"work", "init", ".", pth}
+	if _, err := os.Stat(filepath.Join(dir, "go.work")); err == nil {
+		args = []string{"work", "use", pth}
+	}
+	cmd := exec.Command("go", args...)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf(`failed to run "go %s": %s`,
+			strings.Join(args[:2], " "), bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// Close removes the session's temporary files, unless the session keeps its
+// temporary module, and the files that were copied next to its File, if any.
+func (s *Session) Close() error {
+	if s.kep {
+		return nil
+	}
+	var err error
+	for _, pth := range s.cpd {
+		err = errors.Join(err, os.Remove(pth))
+	}
+	return errors.Join(err, os.RemoveAll(s.tmp))
+}
+
+// Dir returns the directory that programs are built in, and run in unless the
+// session has changed directory. For a session without a File, this is its
+// CacheDir, or its temporary module.
+func (s *Session) Dir() string {
+	if s.dir == "" {
+		return "."
+	}
+	return s.dir
+}
+
+// ExitCode returns the exit status of the program that ran last, or 0 if no
+// program has run.
+func (s *Session) ExitCode() int {
+	return s.xit
+}
+
+// Interrupt stops the program that is running, if any. Eval then returns
+// ErrInterrupt.
+func (s *Session) Interrupt() {
+	select {
+	case s.sig <- struct{}{}:
+	default:
+	}
+}
+
+// Reset removes the input of the session, restoring it to its initial state,
+// as .reset does.
+func (s *Session) Reset() error {
+	s.frm = 0
+	s.efm = 0
+	s.usr = nil
+	s.rem = ""
+	s.erm = ""
+	s.res = 0
+	s.val = nil
+	s.ran = 0
+	s.unu = nil
+	s.rmi = nil
+	s.pin = nil
+	if s.sta != "" {
+		_ = os.Remove(s.sta)
+	}
+	if s.org == nil {
+		s.src = []byte("package main\n\nfunc main() {}\n")
+		s.imp = len("package main")
+		s.top = len("package main\n\n")
+		s.bod = len("package main\n\nfunc main() {")
+		s.off = len(s.src) - 2
+		return nil
+	}
+	s.src = bytes.Clone(s.org)
+	return s.prepareSrc()
+}
+
+func (s *Session) prepareSrc() error {
+	fs := token.NewFileSet()
+	name := filepath.Base(s.pth)
+	const mode = parser.AllErrors | parser.ParseComments
+	root, err := parser.ParseFile(fs, name, s.src, mode)
+	if list := (scanner.ErrorList{}); errors.As(err, &list) {
+		// Each error is on its own line, where ErrorList.Error would only
+		// count those after the first. Only the first on each line is kept.
+		list.RemoveMultiples()
+		errs := make([]error, len(list))
+		for i, e := range list {
+			errs[i] = e
+		}
+		return fmt.Errorf("failed to parse:\n%w", errors.Join(errs...))
+	} else if err != nil {
+		return fmt.Errorf("failed to parse: %w", err)
+	}
+	if root.Name.Name != "main" {
+		// Set to package main.
+		root.Name.Name = "main"
+		var buf bytes.Buffer
+		if err := format.Node(&buf, fs, root); err != nil {
+			return fmt.Errorf("failed to modify source: %w", err)
+		}
+		s.src = buf.Bytes()
+		// Parse again so that offsets refer to the modified source.
+		fs = token.NewFileSet()
+		if root, err = parser.ParseFile(fs, name, s.src, mode); err != nil {
+			return fmt.Errorf("failed to modify source: %w", err)
+		}
+	}
+	s.imp = fs.Position(root.Name.End()).Offset
+	var found bool
+	ast.Inspect(root, func(n ast.Node) bool {
+		fn, ok := n.(*ast.FuncDecl)
+		if !ok || fn.Name.Name != "main" {
+			return true
+		}
+		found = true
+		s.top = fs.Position(fn.Pos()).Offset
+		if fn.Doc != nil {
+			s.top = fs.Position(fn.Doc.Pos()).Offset
+		}
+		s.bod = fs.Position(fn.Body.Lbrace).Offset + 1
+		// The body may be empty, as in "func main() {}".
+		s.off = max(fs.Position(fn.Body.Rbrace).Offset-1, s.bod)
+		return true
+	})
+	if !found {
+		s.top = len(s.src) + len("\n\n")
+		s.bod = s.top + len("func main() {")
+		s.src = append(s.src, []byte("\n\nfunc main() {}\n")...)
+		s.off = len(s.src) - 2
+	}
+	return nil
+}
+
+// Eval evaluates input and returns the standard output that it prints,
+// followed by the values of the watches. Error output is written to the
+// session's Stderr. It returns ErrIncomplete if input is incomplete, without
+// building it.
+func (s *Session) Eval(input string) (string, error) {
+	if s.chk || len(s.wat) == 0 || isBlank(input) {
+		return s.evalInput(input)
+	}
+	// The watches are printed by the program that runs for the input.
+	s.won = true
+	out, err := s.evalInput(input)
+	s.won = false
+	var be buildError
+	if !errors.As(err, &be) || !strings.Contains(be.out, "watch:") {
+		return out, err
+	}
+	// The watches do not build, e.g. because a variable that they print
+	// was removed, so the input runs without them.
+	if out, err = s.evalInput(input); err != nil {
+		return out, err
+	}
+	fmt.Fprintf(s.err,
+		"%v\n(a watch failed; type .unwatch N to remove it)\n", be)
+	return out, nil
+}
+
+// evalInput evaluates input and returns the standard output that it prints.
+func (s *Session) evalInput(input string) (string, error) {
+	if incomplete(input) {
+		return "", ErrIncomplete
+	}
+	raw := s.rebind(joinLines(input)) + "\n"
+	lns := strings.Count(strings.TrimRight(raw, "\n"), "\n") + 1
+	if isBlank(input) {
+		// There is nothing to run, but comments are kept.
+		if strings.TrimSpace(input) != "" {
+			s.usr = append(s.usr, entry{inp: input, usr: raw, lns: lns})
+		}
+		return "", nil
+	}
+	decl, err := isDecl(raw)
+	if err != nil {
+		return "", err
+	}
+	if !decl {
+		if err := s.parseStmts(raw); err != nil {
+			return "", err
+		}
+		if s.shw {
+			s.warnShadows(raw)
+		}
+	}
+	if decl && hasImports(raw) {
+		e, err := fileEntry("input", []byte("package main\n"+raw),
+			s.program(entry{}))
+		if err != nil {
+			return "", err
+		}
+		e.inp, e.lns = input, lns
+		return s.eval(e)
+	} else if decl {
+		return s.eval(entry{inp: input, pkg: raw, lns: lns})
+	} else if exprEnd(raw) < 0 {
+		return s.eval(entry{inp: input, usr: raw, lns: lns})
+	}
+	vals := s.results(1)
+	for {
+		out, err := s.eval(entry{
+			inp: input,
+			usr: printExpr(raw, vals, s.aut),
+			lns: lns,
+			val: vals,
+		})
+		var be buildError
+		if !errors.As(err, &be) {
+			return out, err
+		}
+		retry := false
+		for line := range strings.SplitSeq(be.out, "\n") {
+			m := builderr.FindStringSubmatch(line)
+			if m == nil {
+				continue
+			}
+			if strings.HasSuffix(m[4], novalue) {
+				// The expression has no value to print.
+				return s.eval(entry{inp: input, usr: raw, lns: lns})
+			} else if n := mismatch.FindStringSubmatch(m[4]); n != nil {
+				// The expression has multiple values.
+				if count, _ := strconv.Atoi(n[1]); count != len(vals) {
+					retry = true
+					vals = s.results(count)
+				}
+			}
+		}
+		if !retry {
+			return out, err
+		}
+	}
+}
+
+// eval runs the program with e appended and returns its new output. If it
+// succeeds, e is added to the session. Variables and imports that are not used
+// are fixed automatically. If the program fails to build, eval returns a
+// buildError.
+func (s *Session) eval(e entry) (string, error) {
+	e.red = s.redeclared(e.usr)
+	if s.sta != "" {
+		if err := s.declare(&e); err != nil {
+			return "", err
+		}
+	}
+	unu := slices.Clone(s.unu) // Variables that are not used.
+	var blank []string         // Imports that are not used.
+	var got []string           // Packages that were fetched with go get.
+rerun:
+	f := e
+	for _, name := range unu {
+		f.usr += "_ = " + name + "\n"
+	}
+	src := s.source(f)
+	buf, err := s.goimports(s.pth, src)
+	if err != nil && strings.Contains(err.Error(), foundEOF) {
+		return "", ErrIncomplete
+	} else if err != nil {
+		return "", fmt.Errorf("failed to process imports: %w", err)
+	}
+	if s.chooseImports(src, buf) {
+		goto rerun
+	}
+	// Removed imports are blank, so that their names are not declared.
+	buf = withImports(src, buf, s.pth)
+	buf = blankImports(buf, slices.Concat(s.rmi, blank))
+	if err := s.writeFiles(map[string][]byte{s.pth: buf}); err != nil {
+		return "", err
+	}
+	if s.trc {
+		fmt.Fprintf(s.err, "// %s\n%s", s.pth, buf)
+	}
+	start := time.Now()
+	err = s.build(buf)
+	s.bld += time.Since(start)
+	if be := (buildError{}); errors.As(err, &be) {
+		// This is a compile error, so try to fix it.
+		var fixed bool
+		for line := range strings.SplitSeq(be.out, "\n") {
+			m := builderr.FindStringSubmatch(line)
+			if m == nil {
+				continue
+			}
+			name, ok := strings.CutPrefix(m[4], unused)
+			if ok && s.fix && !slices.Contains(unu, name) {
+				fixed = true
+				unu = append(unu, name)
+			}
+			n := unusedimp.FindStringSubmatch(m[4])
+			if n != nil && !slices.Contains(blank, n[1]) {
+				fixed = true
+				blank = append(blank, n[1])
+			}
+		}
+		if fixed {
+			goto rerun
+		}
+		m := nomodule.FindStringSubmatch(be.out)
+		if m != nil && s.get && !slices.Contains(got, m[1]) {
+			got = append(got, m[1])
+			if err := s.goGet(m[1]); err != nil {
+				return "", err
+			}
+			goto rerun
+		} else if m != nil && !s.get {
+			return "", fmt.Errorf(
+				"%w\n(run igo -get to get missing modules)", err)
+		}
+		return "", err
+	} else if err != nil {
+		return "", err
+	} else if s.chk {
+		return "", nil
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(s.bin, s.arg...)
+	cmd.Dir = s.cwd
+	cmd.Env = s.environ()
+	if s.det {
+		// The functions of math/rand are seeded with 1, as before Go 1.20.
+		if cmd.Env == nil {
+			cmd.Env = os.Environ()
+		}
+		debug := "GODEBUG=randautoseed=0"
+		for _, kv := range cmd.Env {
+			if v, ok := strings.CutPrefix(kv, "GODEBUG="); ok && v != "" {
+				debug += "," + v
+			}
+		}
+		cmd.Env = append(cmd.Env, debug)
+	}
+	if s.wrt != nil {
+		cmd = s.sandboxed(cmd)
+	}
+	if s.inp != nil {
+		// Every run reads the same input from the start.
+		cmd.Stdin = bytes.NewReader(s.inp)
+	}
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	start = time.Now()
+	err = s.wait(cmd, s.lim)
+	s.exe += time.Since(start)
+	if errors.Is(err, ErrInterrupt) || errors.Is(err, ErrTimeout) {
+		return "", err
+	}
+	if ee := new(exec.ExitError); errors.As(err, &ee) {
+		s.xit = ee.ExitCode()
+	} else if err == nil {
+		s.xit = 0
+	}
+	stdo, srem := s.newLines(stdout.String(), s.frm)
+	stde, erem := s.newLines(stderr.String(), s.efm)
+	var vals string // Values of the watches.
+	if s.won {
+		if v, rest, ok := strings.Cut(srem, s.eof+watchedMarker); ok {
+			vals, srem = v, rest
+		}
+	}
+	if err != nil {
+		// The program failed, so return its output and its error, which
+		// has its exit status. Output after the marker is included, since
+		// it may explain the failure, e.g. a data race reported at exit.
+		msg := inputLines(stde + erem)
+		if n := s.panicked(msg); n > 0 {
+			// The entry ran before, but panics now, e.g. because a file
+			// that it reads was removed.
+			return stdo + srem, fmt.Errorf(
+				"%s%w\n(entry %d panicked; type .delete %d to remove it)",
+				msg, err, n, n)
+		}
+		if callsExit(e.usr) {
+			return stdo + srem, fmt.Errorf("%s%w\n%s", msg, err, exitHint)
+		}
+		return stdo + srem, fmt.Errorf("%s%w", msg, err)
+	}
+	if !strings.Contains(stdout.String(), s.eof+"\n") {
+		// The program exited early, e.g. with os.Exit(0), which would stop
+		// every run that follows.
+		err := fmt.Errorf("%sprogram exited before the end of input",
+			inputLines(stde))
+		if callsExit(e.usr) {
+			err = fmt.Errorf("%w\n%s", err, exitHint)
+		}
+		return stdo, err
+	}
+	if e.val != nil {
+		s.res++
+		s.val = e.val
+	}
+	if e.lns == 0 {
+		e.lns = strings.Count(e.pkg+e.usr, "\n")
+	}
+	e.out = strings.Count(stdo, "\n")
+	e.err = strings.Count(stde, "\n")
+	s.usr = append(s.usr, e)
+	s.unu = unusedVars(buf, unu)
+	if s.sta != "" {
+		// Output of entries that have run is not repeated.
+		s.ran = len(s.usr)
+	} else {
+		s.frm += e.out
+		s.efm += e.err
+	}
+	// Output after the marker, such as from deferred calls, is printed again
+	// by every run, so it is only returned when it changes.
+	if srem != s.rem {
+		stdo += srem
+	}
+	if erem != s.erm {
+		stde += erem
+	}
+	s.rem, s.erm = srem, erem
+	s.lst = stdo
+	fmt.Fprint(s.err, stde)
+	return stdo + vals, nil
+}
+
+// panicked returns the number of the entry of the session that main()
+// panicked in, according to the stack trace in output, or 0 if there is none.
+func (s *Session) panicked(output string) int {
+	m := mainframe.FindStringSubmatch(output)
+	if m == nil {
+		return 0
+	}
+	line, _ := strconv.Atoi(m[1])
+	start := 1
+	for i, e := range s.usr {
+		if line >= start && line < start+e.lns {
+			return i + 1
+		}
+		start += e.lns
+	}
+	return 0
+}
+
+// environ returns the environment of programs and shell commands, or nil if
+// they inherit it.
+func (s *Session) environ() []string {
+	if len(s.env) == 0 {
+		return nil
+	}
+	env := os.Environ()
+	for _, kv := range s.env {
+		key, _, set := strings.Cut(kv, "=")
+		env = slices.DeleteFunc(env, func(e string) bool {
+			return strings.HasPrefix(e, key+"=")
+		})
+		if set {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+// build compiles src, the program at s.pth, to s.bin, unless it is the program
+// that was compiled last. If src fails to compile, build returns a buildError.
+//
+// Debug information is omitted, as with go run, since it takes time to link.
+// Stack traces still have file and line information.
+func (s *Session) build(src []byte) error {
+	sum := sha256.Sum256(src)
+	if sum == s.sum {
+		return nil
+	}
+	s.sum = [sha256.Size]byte{}
+	bin := s.bin
+	var env []string
+	if s.chk && (s.gos != "" || s.gar != "") {
+		// Programs for other platforms cannot run, so they are not kept.
+		bin, env = os.DevNull, os.Environ()
+		if s.gos != "" {
+			env = append(env, "GOOS="+s.gos)
+		}
+		if s.gar != "" {
+			env = append(env, "GOARCH="+s.gar)
+		}
+	}
+	if s.wrt != nil && env == nil {
+		env = append(os.Environ(), "GOOS=wasip1", "GOARCH=wasm")
+	}
+	var out bytes.Buffer
+	args := []string{"build", "-ldflags=-s -w", "-o", bin}
+	if s.rac {
+		args = append(args, "-race")
+	}
+	args = append(args, s.buildFlags()...)
+	cmd := exec.Command("go", append(args, s.pth)...)
+	cmd.Dir, cmd.Env = s.dir, env
+	cmd.Stdout, cmd.Stderr = &out, &out
+	stop := s.progress("building")
+	err := s.wait(cmd, 0)
+	stop()
+	if ee := new(exec.ExitError); errors.As(err, &ee) {
+		return buildError{strings.TrimSuffix(out.String(), "\n"), src}
+	} else if errors.Is(err, ErrInterrupt) {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("failed to build: %w", err)
+	}
+	if bin == s.bin {
+		s.sum = sum
+	}
+	return nil
+}
+
+// writeFiles writes files, the source of each by path, for go build and go
+// test. The files of a session with a File are the user's, so they are left as
+// they are: the source is written to the temporary directory instead, and
+// builds use it in their place through an overlay.
+func (s *Session) writeFiles(files map[string][]byte) error {
+	if s.org == nil {
+		for pth, src := range files {
+			if err := os.WriteFile(pth, src, 0644); err != nil {
+				return fmt.Errorf("failed to write file: %w", err)
+			}
+		}
+		return nil
+	}
+	dir := filepath.Join(s.tmp, "overlay")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	replace := make(map[string]string)
+	for pth, src := range files {
+		abs, err := filepath.Abs(pth)
+		if err != nil {
+			return fmt.Errorf("bad file %q: %w", pth, err)
+		}
+		tmp := filepath.Join(dir, filepath.Base(pth))
+		if err := os.WriteFile(tmp, src, 0644); err != nil {
+			return fmt.Errorf("failed to write file: %w", err)
+		}
+		replace[abs] = tmp
+	}
+	buf, err := json.Marshal(map[string]any{"Replace": replace})
+	if err != nil {
+		return fmt.Errorf("failed to write overlay: %w", err)
+	}
+	if err := os.WriteFile(dir+".json", buf, 0644); err != nil {
+		return fmt.Errorf("failed to write overlay: %w", err)
+	}
+	return nil
+}
+
+// buildFlags returns the flags of go build and go test: the session's build
+// flags, and the overlay of its File, if any.
+func (s *Session) buildFlags() []string {
+	if s.org == nil {
+		return s.flg
+	}
+	ovl := "-overlay=" + filepath.Join(s.tmp, "overlay.json")
+	return append(slices.Clip(s.flg), ovl)
+}
+
+// buildDefault guards build.Default, which goimports matches files with.
+var buildDefault sync.RWMutex
+
+// goimports runs goimports on src, the source of pth. goimports only adds the
+// packages whose files build for build.Default, so while checks are for
+// another platform, it is set to that platform.
+func (s *Session) goimports(pth string, src []byte) ([]byte, error) {
+	if !s.chk || (s.gos == "" && s.gar == "") {
+		buildDefault.RLock()
+		defer buildDefault.RUnlock()
+		return imports.Process(pth, src, nil)
+	}
+	buildDefault.Lock()
+	defer buildDefault.Unlock()
+	ctx := build.Default
+	defer func() { build.Default = ctx }()
+	build.Default.GOOS = cmp.Or(s.gos, ctx.GOOS)
+	build.Default.GOARCH = cmp.Or(s.gar, ctx.GOARCH)
+	return imports.Process(pth, src, nil)
+}
+
+// A wasmRuntime runs WebAssembly programs for sandboxed sessions.
+type wasmRuntime struct {
+	path string // Path to the runtime.
+	run  string // Subcommand that runs a program.
+	env  string // Flag that sets an environment variable of the program.
+}
+
+// wasmRuntimes are the WebAssembly runtimes that are looked for in $PATH, in
+// order of preference.
+var wasmRuntimes = []wasmRuntime{
+	{"wasmtime", "run", "--env"},
+	{"wazero", "run", "-env"},
+}
+
+// findRuntime returns the first of wasmRuntimes that is installed.
+func findRuntime() (*wasmRuntime, error) {
+	for _, rt := range wasmRuntimes {
+		if pth, err := exec.LookPath(rt.path); err == nil {
+			rt.path = pth
+			return &rt, nil
+		}
+	}
+	return nil, errors.New("sandbox needs wasmtime or wazero in $PATH")
+}
+
+// sandboxed returns a command that runs cmd, a WebAssembly program, with the
+// session's runtime. The variables of cmd.Env that are not in the environment
+// of igo, such as those set by .env, are passed to the program, but the rest
+// of the environment is not.
+func (s *Session) sandboxed(cmd *exec.Cmd) *exec.Cmd {
+	host := make(map[string]bool)
+	for _, kv := range os.Environ() {
+		host[kv] = true
+	}
+	args := []string{s.wrt.run}
+	for _, kv := range cmd.Env {
+		if !host[kv] {
+			args = append(args, s.wrt.env, kv)
+		}
+	}
+	sbx := exec.Command(s.wrt.path, append(args, cmd.Args...)...)
+	sbx.Dir, sbx.Stdin = cmd.Dir, cmd.Stdin
+	return sbx
+}
+
+// progressDelay is how long an action runs before its progress is shown.
+const progressDelay = 200 * time.Millisecond
+
+// progress shows a spinner and what is being done on the progress indicator,
+// if any, after progressDelay. The returned function erases it.
+func (s *Session) progress(what string) (stop func()) {
+	if s.prg == nil {
+		return func() {}
+	}
+	done, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(exited)
+		timer := time.NewTimer(progressDelay)
+		defer timer.Stop()
+		select {
+		case <-done:
+			return
+		case <-timer.C:
+		}
+		tick := time.NewTicker(100 * time.Millisecond)
+		defer tick.Stop()
+		for i := 0; ; i++ {
+			fmt.Fprintf(s.prg, "\r%c %s", `|/-\`[i%4], what)
+			select {
+			case <-done:
+				fmt.Fprint(s.prg, "\r\x1b[K")
+				return
+			case <-tick.C:
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
+
+// goGet runs go get for pkg in the session's module.
+func (s *Session) goGet(pkg string) error {
+	var out bytes.Buffer
+	cmd := exec.Command("go", "get", pkg)
+	cmd.Dir = s.dir
+	cmd.Stdout, cmd.Stderr = &out, &out
+	err := s.wait(cmd, 0)
+	if ee := new(exec.ExitError); errors.As(err, &ee) {
+		return fmt.Errorf("failed to get %s: %s", pkg,
+			bytes.TrimSpace(out.Bytes()))
+	} else if err != nil {
+		return err
+	}
+	fmt.Fprint(s.err, out.String())
+	return nil
+}
+
+// goTool runs the go command with args in dir and returns its output. If the
+// command fails, the error is its error output.
+func (s *Session) goTool(dir string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("go", args...)
+	cmd.Dir = dir
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := s.wait(cmd, 0)
+	if ee := new(exec.ExitError); errors.As(err, &ee) {
+		return "", errors.New(strings.TrimSpace(stderr.String()))
+	} else if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// wait runs cmd in a new process group and waits for it to exit. It kills the
+// process group and returns ErrTimeout if cmd runs for longer than lim, unless
+// lim is 0, or ErrInterrupt if the session is interrupted.
+func (s *Session) wait(cmd *exec.Cmd, lim time.Duration) error {
+	for len(s.sig) > 0 {
+		<-s.sig // Ignore interrupts received before running.
+	}
+	setGroup(cmd)
+	cmd.WaitDelay = time.Second
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	var timeout <-chan time.Time
+	if lim > 0 {
+		t := time.NewTimer(lim)
+		defer t.Stop()
+		timeout = t.C
+	}
+	var err error
+	select {
+	case err := <-done:
+		return err
+	case <-s.sig:
+		err = ErrInterrupt
+	case <-timeout:
+		err = ErrTimeout
+	}
+	_ = killGroup(cmd)
+	<-done
+	return err
+}
+
+// isDecl reports whether input consists of function, method, type, constant,
+// or import declarations, or variables with //go:embed directives, which are
+// placed at package scope. Constants are placed there so that functions can
+// use them. It returns ErrIncomplete if input is an incomplete declaration.
+func isDecl(input string) (bool, error) {
+	root, err := parser.ParseFile(token.NewFileSet(), "",
+		"package main\n"+input, parser.ParseComments)
+	if err != nil && strings.Contains(err.Error(), foundEOF) {
+		return false, ErrIncomplete
+	} else if err != nil || len(root.Decls) == 0 {
+		return false, nil
+	}
+	for _, d := range root.Decls {
+		gen, ok := d.(*ast.GenDecl)
+		if ok && gen.Tok == token.VAR && !isEmbed(gen.Doc) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// isEmbed reports whether doc has a //go:embed directive.
+func isEmbed(doc *ast.CommentGroup) bool {
+	if doc == nil {
+		return false
+	}
+	for _, c := range doc.List {
+		if strings.HasPrefix(c.Text, embed) {
+			return true
+		}
+	}
+	return false
+}
+
+// callsExit reports whether the statements in input call os.Exit.
+func callsExit(input string) bool {
+	root, err := parser.ParseFile(token.NewFileSet(), "",
+		"package main\nfunc main() {\n"+input+"\n}", 0)
+	if err != nil {
+		return false
+	}
+	var found bool
+	ast.Inspect(root, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok {
+			return !found
+		}
+		sel, ok := call.Fun.(*ast.SelectorExpr)
+		if !ok || sel.Sel.Name != "Exit" {
+			return true
+		}
+		if id, ok := sel.X.(*ast.Ident); ok && id.Name == "os" {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+// isBlank reports whether input has nothing but comments and spaces.
+func isBlank(input string) bool {
+	fs := token.NewFileSet()
+	var sc scanner.Scanner
+	sc.Init(fs.AddFile("", -1, len(input)), []byte(input), nil, 0)
+	_, tok, _ := sc.Scan()
+	return tok == token.EOF
+}
+
+// Incomplete reports whether input is incomplete, so that Eval would return
+// ErrIncomplete rather than evaluate it.
+func Incomplete(input string) bool {
+	return incomplete(input)
+}
+
+// incomplete reports whether input ends before the end of a statement or
+// declaration, such as within brackets, after an operator, within a raw string
+// or a block comment, or after a //go: directive or a backslash. Brackets and
+// backslashes are counted as tokens, so those in strings, runes, and comments
+// are not counted. Interpreted strings cannot span lines, so an unterminated
+// one is an error rather than incomplete.
+func incomplete(input string) bool {
+	fs := token.NewFileSet()
+	var sc scanner.Scanner
+	var open bool
+	eh := func(_ token.Position, msg string) {
+		open = open || msg == "raw string literal not terminated" ||
+			msg == "comment not terminated"
+	}
+	sc.Init(fs.AddFile("", -1, len(input)), []byte(input), eh,
+		scanner.ScanComments)
+	depth, last := 0, token.ILLEGAL
+	var directive bool // Whether the last token is a directive.
+	var backslash bool // Whether the last token is a backslash.
+	for {
+		_, tok, lit := sc.Scan()
+		if tok == token.EOF {
+			break
+		} else if tok == token.COMMENT {
+			directive = strings.HasPrefix(lit, "//go:")
+			continue
+		} else if tok != token.SEMICOLON || lit != "\n" {
+			directive = false
+			backslash = tok == token.ILLEGAL && lit == `\`
+		}
+		switch tok {
+		case token.LPAREN, token.LBRACK, token.LBRACE:
+			depth++
+		case token.RPAREN, token.RBRACK, token.RBRACE:
+			depth--
+		}
+		if tok != token.SEMICOLON || lit != "\n" {
+			last = tok
+		}
+	}
+	if open || depth > 0 || directive || backslash {
+		return true
+	}
+	switch last {
+	case token.ILLEGAL, token.IDENT, token.INT, token.FLOAT, token.IMAG,
+		token.CHAR, token.STRING, token.BREAK, token.CONTINUE,
+		token.FALLTHROUGH, token.RETURN, token.INC, token.DEC,
+		token.RPAREN, token.RBRACK, token.RBRACE, token.SEMICOLON:
+		// A statement can end here.
+		return false
+	}
+	return true
+}
+
+// joinLines replaces backslashes that end lines of input, outside of literals
+// and comments, with spaces, so that columns do not move.
+func joinLines(input string) string {
+	fs := token.NewFileSet()
+	var sc scanner.Scanner
+	file := fs.AddFile("", -1, len(input))
+	sc.Init(file, []byte(input), nil, scanner.ScanComments)
+	buf := []byte(input)
+	for {
+		pos, tok, lit := sc.Scan()
+		if tok == token.EOF {
+			break
+		} else if tok != token.ILLEGAL || lit != `\` {
+			continue
+		}
+		off := file.Offset(pos)
+		rest := strings.TrimLeft(input[off+1:], " \t\r")
+		if rest == "" || rest[0] == '\n' {
+			buf[off] = ' '
+		}
+	}
+	return string(buf)
+}
+
+// parseStmts parses input as statements in the body of main(), which must not
+// return. Errors refer to input lines.
+func (s *Session) parseStmts(input string) error {
+	line := 1
+	for _, e := range s.usr {
+		line += e.lns
+	}
+	src := fmt.Sprintf("package main\nfunc main() {\n//line input:%d:1\n%s\n}",
+		line, input)
+	fs := token.NewFileSet()
+	root, err := parser.ParseFile(fs, "", src, 0)
+	if err != nil && strings.Contains(err.Error(), foundEOF) {
+		return ErrIncomplete
+	} else if err != nil {
+		return errors.New(inputLines(err.Error()))
+	}
+	// Returning from main() would skip the marker that ends the output.
+	var ret token.Pos
+	ast.Inspect(root, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.ReturnStmt:
+			if !ret.IsValid() {
+				ret = n.Pos()
+			}
+		}
+		return true
+	})
+	if ret.IsValid() {
+		return fmt.Errorf("%s: cannot return from REPL top level",
+			inputLines(fs.Position(ret).String()))
+	}
+	return nil
+}
+
+// redeclared returns the variables that the statements in input declare again
+// at the top level of main(), with := or var. Such statements would not
+// compile, so they start a new block in which the variables are shadowed.
+func (s *Session) redeclared(input string) []string {
+	have := make(map[string]bool)
+	body := []string{string(s.src[s.bod:s.off])}
+	for _, e := range s.usr {
+		body = append(body, e.usr)
+	}
+	for _, b := range body {
+		for _, names := range topVars(b) {
+			for _, name := range names {
+				have[name] = true
+			}
+		}
+	}
+	var red []string
+	for _, names := range topVars(input) {
+		if len(names) > 0 && !slices.ContainsFunc(names, func(n string) bool {
+			return !have[n]
+		}) {
+			red = append(red, names...)
+		}
+	}
+	return red
+}
+
+// warnShadows warns of the variables that the statements in input declare
+// with the names of builtins, such as len, or of imported packages, which
+// later input can then no longer refer to.
+func (s *Session) warnShadows(input string) {
+	vars := topVars(input)
+	if len(vars) == 0 {
+		return
+	}
+	pkgs := make(map[string]string) // Imported paths, by name.
+	if specs, err := s.importSpecs(); err == nil {
+		for _, spec := range specs {
+			pth, _ := strconv.Unquote(spec.Path.Value)
+			name := pkgName(pth)
+			if spec.Name != nil {
+				name = spec.Name.Name
+			}
+			pkgs[name] = pth
+		}
+	}
+	for _, names := range vars {
+		for _, name := range names {
+			if pth, ok := pkgs[name]; ok {
+				fmt.Fprintf(s.err, "warning: %s shadows package %s\n",
+					name, pth)
+			} else if types.Universe.Lookup(name) != nil {
+				fmt.Fprintf(s.err, "warning: %s shadows a builtin\n", name)
+			}
+		}
+	}
+}
+
+// topVars returns the variables declared by the statements in input, other
+// than in nested blocks. Each list of names is declared by a short variable
+// declaration, which must declare one of them for the first time, or is a
+// single name declared by var.
+func topVars(input string) [][]string {
+	root, err := parser.ParseFile(token.NewFileSet(), "",
+		"package main\nfunc main() {\n"+input+"\n}", 0)
+	if err != nil {
+		return nil
+	}
+	var vars [][]string
+	for _, d := range root.Decls {
+		fn, ok := d.(*ast.FuncDecl)
+		if !ok {
+			continue
+		}
+		for _, stmt := range fn.Body.List {
+			switch stmt := stmt.(type) {
+			case *ast.AssignStmt:
+				if stmt.Tok != token.DEFINE {
+					continue
+				}
+				var names []string
+				for _, x := range stmt.Lhs {
+					if id, ok := x.(*ast.Ident); ok && id.Name != "_" {
+						names = append(names, id.Name)
+					}
+				}
+				vars = append(vars, names)
+			case *ast.DeclStmt:
+				gd, ok := stmt.Decl.(*ast.GenDecl)
+				if !ok || gd.Tok != token.VAR {
+					continue
+				}
+				for _, spec := range gd.Specs {
+					for _, id := range spec.(*ast.ValueSpec).Names {
+						if id.Name != "_" {
+							vars = append(vars, []string{id.Name})
+						}
+					}
+				}
+			}
+		}
+	}
+	return vars
+}
+
+// hasImports reports whether input has import declarations.
+func hasImports(input string) bool {
+	root, err := parser.ParseFile(token.NewFileSet(), "",
+		"package main\n"+input, parser.ImportsOnly)
+	return err == nil && len(root.Imports) > 0
+}
+
+// withImports returns src, the program at pth, with the imports of fmtd, which
+// is src as processed by goimports. The rest of src is not formatted, so that
+// columns are not moved, and a line directive keeps its positions.
+func withImports(src, fmtd []byte, pth string) []byte {
+	end := func(fs *token.FileSet, src []byte) (*token.File, int, bool) {
+		root, err := parser.ParseFile(fs, "", src,
+			parser.ImportsOnly|parser.ParseComments)
+		if err != nil {
+			return nil, 0, false
+		}
+		pos := root.Name.End()
+		for _, d := range root.Decls {
+			pos = d.End()
+		}
+		file := fs.File(pos)
+		return file, file.Offset(pos), true
+	}
+	file, off, ok := end(token.NewFileSet(), src)
+	_, fmtOff, fmtOK := end(token.NewFileSet(), fmtd)
+	if !ok || !fmtOK {
+		return fmtd
+	}
+	p := file.PositionFor(file.Pos(off), true)
+	if p.Filename == "" {
+		p.Filename, _ = filepath.Abs(pth)
+	}
+	var b bytes.Buffer
+	b.Write(fmtd[:fmtOff])
+	fmt.Fprintf(&b, "/*line %s:%d:%d*/", p.Filename, p.Line, p.Column)
+	b.Write(src[off:])
+	return b.Bytes()
+}
+
+// unusedVars returns the variables of names that are not used in the body of
+// main() in src, other than by being assigned to _.
+func unusedVars(src []byte, names []string) []string {
+	root, err := parser.ParseFile(token.NewFileSet(), "", src, 0)
+	if err != nil {
+		return names
+	}
+	count := make(map[string]int)
+	for _, d := range root.Decls {
+		if fn, ok := d.(*ast.FuncDecl); ok && fn.Name.Name == "main" {
+			ast.Inspect(fn.Body, func(n ast.Node) bool {
+				if id, ok := n.(*ast.Ident); ok {
+					count[id.Name]++
+				}
+				return true
+			})
+		}
+	}
+	var vars []string
+	for _, name := range names {
+		// The variable is named by its declaration and by _ = name.
+		if count[name] <= 2 {
+			vars = append(vars, name)
+		}
+	}
+	return vars
+}
+
+// chooseImports keeps the imports that goimports added to src, in buf, for
+// the rest of the session if packages of the standard library have the same
+// name. If they also have the members that src uses, the package to import is
+// chosen first. chooseImports reports whether a different package was chosen,
+// so that src must be processed again.
+func (s *Session) chooseImports(src, buf []byte) bool {
+	fs := token.NewFileSet()
+	root, err := parser.ParseFile(fs, "", src, 0)
+	if err != nil {
+		return false
+	}
+	have := make(map[string]bool)
+	for _, spec := range root.Imports {
+		have[spec.Path.Value] = true
+	}
+	fmtd, err := parser.ParseFile(token.NewFileSet(), "", buf,
+		parser.ImportsOnly)
+	if err != nil {
+		return false
+	}
+	var changed bool
+	for _, spec := range fmtd.Imports {
+		if have[spec.Path.Value] || spec.Name != nil {
+			continue
+		}
+		pth, _ := strconv.Unquote(spec.Path.Value)
+		name := pkgName(pth)
+		paths := slices.DeleteFunc(slices.Clone(stdPaths()[name]),
+			func(p string) bool { return p == pth })
+		if len(paths) == 0 {
+			continue
+		}
+		paths = withMembers(paths, selectors(root, name))
+		choice := pth
+		if len(paths) > 0 && s.cho != nil {
+			paths = append([]string{pth}, paths...)
+			choice = cmp.Or(s.cho(name, paths), pth)
+		} else if len(paths) > 0 {
+			fmt.Fprintf(s.err, "warning: importing %s, not %s\n", pth,
+				strings.Join(paths, " or "))
+		}
+		s.pin = append(s.pin, strconv.Quote(choice))
+		changed = changed || choice != pth
+	}
+	return changed
+}
+
+// selectors returns the names that root selects from name, as in name.X.
+func selectors(root *ast.File, name string) []string {
+	var sels []string
+	ast.Inspect(root, func(n ast.Node) bool {
+		sel, ok := n.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		if id, ok := sel.X.(*ast.Ident); ok && id.Name == name {
+			sels = append(sels, sel.Sel.Name)
+		}
+		return true
+	})
+	return sels
+}
+
+// withMembers returns the packages of paths that declare all of names.
+func withMembers(paths, names []string) []string {
+	pkgs, err := packages.Load(&packages.Config{
+		Mode: packages.NeedName | packages.NeedTypes,
+	}, paths...)
+	if err != nil {
+		return nil
+	}
+	var have []string
+	for _, pkg := range pkgs {
+		if pkg.Types != nil && !slices.ContainsFunc(names, func(n string) bool {
+			return pkg.Types.Scope().Lookup(n) == nil
+		}) {
+			have = append(have, pkg.PkgPath)
+		}
+	}
+	return have
+}
+
+// blankImports renames the imports of the quoted paths in blank to _, so that
+// the program builds while they are not used.
+func blankImports(src []byte, blank []string) []byte {
+	if len(blank) == 0 {
+		return src
+	}
+	fs := token.NewFileSet()
+	root, err := parser.ParseFile(fs, "", src, parser.ImportsOnly)
+	if err != nil {
+		return src
+	}
+	offset := func(pos token.Pos) int {
+		return fs.PositionFor(pos, false).Offset
+	}
+	var b bytes.Buffer
+	last := 0
+	for _, spec := range root.Imports {
+		if !slices.Contains(blank, spec.Path.Value) || isInternal(spec) {
+			continue
+		}
+		pos := spec.Path.Pos()
+		if spec.Name != nil {
+			pos = spec.Name.Pos()
+		}
+		b.Write(src[last:offset(pos)])
+		b.WriteString("_ ")
+		last = offset(spec.Path.Pos())
+	}
+	b.Write(src[last:])
+	return b.Bytes()
+}
+
+// isInternal reports whether spec is one of the imports of igo's helpers,
+// which are named with the _igo prefix.
+func isInternal(spec *ast.ImportSpec) bool {
+	return spec.Name != nil && strings.HasPrefix(spec.Name.Name, "_igo")
+}
+
+// results returns the names of n variables to hold the next results.
+func (s *Session) results(n int) []string {
+	vals := make([]string, n)
+	for i := range vals {
+		vals[i] = fmt.Sprintf("_igo%d_%d", s.res+1, i+1)
+	}
+	return vals
+}
+
+// rebind replaces references to _ and _N in input with the variables holding
+// the last results, where _ is the first result and _N is the Nth result.
+func (s *Session) rebind(input string) string {
+	if len(s.val) == 0 {
+		return input
+	}
+	const prefix = "package main\nfunc _() {\n"
+	fs := token.NewFileSet()
+	root, err := parser.ParseFile(fs, "", prefix+input+"\n}", 0)
+	if err != nil {
+		return input
+	}
+	// Blank identifiers on the left side are assignments, not references.
+	skip := make(map[*ast.Ident]bool)
+	ast.Inspect(root, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.AssignStmt:
+			for _, e := range n.Lhs {
+				if id, ok := e.(*ast.Ident); ok {
+					skip[id] = true
+				}
+			}
+		case *ast.RangeStmt:
+			for _, e := range []ast.Expr{n.Key, n.Value} {
+				if id, ok := e.(*ast.Ident); ok {
+					skip[id] = true
+				}
+			}
+		case *ast.ValueSpec:
+			for _, id := range n.Names {
+				skip[id] = true
+			}
+		case *ast.Field:
+			for _, id := range n.Names {
+				skip[id] = true
+			}
+		case *ast.SelectorExpr:
+			skip[n.Sel] = true
+		}
+		return true
+	})
+	var ids []*ast.Ident
+	ast.Inspect(root, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok && !skip[id] {
+			ids = append(ids, id)
+		}
+		return true
+	})
+	for i := len(ids) - 1; i >= 0; i-- {
+		m := resultvar.FindStringSubmatch(ids[i].Name)
+		if m == nil {
+			continue
+		}
+		n := 1
+		if m[1] != "" {
+			n, _ = strconv.Atoi(m[1])
+		}
+		if n < 1 || n > len(s.val) {
+			continue
+		}
+		off := fs.Position(ids[i].Pos()).Offset - len(prefix)
+		if off < 0 {
+			continue
+		}
+		input = input[:off] + s.val[n-1] + input[off+len(ids[i].Name):]
+	}
+	return input
+}
+
+// exprEnd returns the offset to the end of input if it is an expression whose
+// value should be printed, or -1 otherwise. Calls to the fmt package's print
+// functions are not considered, since they already print.
+func exprEnd(input string) int {
+	fs := token.NewFileSet()
+	expr, err := parser.ParseExprFrom(fs, "", input, 0)
+	if err != nil {
+		return -1
+	}
+	if call, ok := expr.(*ast.CallExpr); ok {
+		if sel, ok := call.Fun.(*ast.SelectorExpr); ok {
+			pkg, ok := sel.X.(*ast.Ident)
+			name := sel.Sel.Name
+			if ok && pkg.Name == "fmt" && (strings.HasPrefix(name, "Print") ||
+				strings.HasPrefix(name, "Fprint")) {
+				return -1
+			}
+		}
+	}
+	return fs.Position(expr.End()).Offset
+}
+
+// printExpr assigns the expression in input to vals and prints them, or only
+// uses them if print is not set.
+func printExpr(input string, vals []string, print bool) string {
+	end := exprEnd(input)
+	lhs := strings.Join(vals, ", ")
+	use := "_igoPrint(" + lhs + ")"
+	if !print {
+		use = strings.Repeat("_, ", len(vals)-1) + "_ = " + lhs
+	}
+	return lhs + " := " + input[:end] + "\n" + use + input[end:]
+}
+
+// source assembles the program to run, with e appended to the session.
+func (s *Session) source(e entry) []byte {
+	e.usr += "_igoEOF()"
+	if s.won {
+		e.usr += "\n" + s.watchCode() + "_igoWatched()"
+	}
+	return s.assemble(e, true)
+}
+
+// program assembles the program, with e appended to the session.
+func (s *Session) program(e entry) []byte {
+	return s.assemble(e, false)
+}
+
+// assemble assembles the program, with e appended to the session. If run is
+// set, it assembles the program to run: line directives map positions in user
+// code to input line numbers, so that errors refer to the lines that were typed
+// rather than to the program, and in stateful mode, entries that have already
+// run are replaced by their variables, which are restored from the state file.
+func (s *Session) assemble(e entry, run bool) []byte {
+	var b bytes.Buffer
+	pth, _ := filepath.Abs(s.pth)
+	base := func(off int) {
+		if run {
+			line := 1 + bytes.Count(s.src[:off], []byte("\n"))
+			col := off - bytes.LastIndexByte(s.src[:off], '\n')
+			fmt.Fprintf(&b, "/*line %s:%d:%d*/", pth, line, col)
+		}
+	}
+	in := s.linePath("input")
+	input := func(line int) {
+		if run {
+			fmt.Fprintf(&b, "/*line %s:%d:1*/", in, line)
+		}
+	}
+	usr := append(slices.Clip(s.usr), e)
+	start := make([]int, len(usr))
+	for i, line := 0, 1; i < len(usr); i++ {
+		start[i] = line
+		line += usr[i].lns
+	}
+	stateful := run && s.sta != ""
+	ran := 0
+	if stateful {
+		ran = s.ran
+	}
+	b.Write(s.src[:s.imp])
+	b.WriteString("\n")
+	for i, e := range usr {
+		if e.imp != "" {
+			input(start[i])
+			b.WriteString(e.imp)
+		}
+	}
+	for _, pth := range s.pin {
+		b.WriteString("import " + pth + "\n")
+	}
+	if s.trn && !s.bar {
+		b.WriteString(truncImports)
+	}
+	if slices.ContainsFunc(usr, func(e entry) bool {
+		return strings.Contains(e.pkg, embed)
+	}) {
+		// //go:embed directives need the embed package to be imported.
+		b.WriteString("import _ \"embed\"\n")
+	}
+	base(s.imp)
+	b.Write(s.src[s.imp:s.top])
+	for i, e := range usr {
+		if e.pkg != "" && !strings.Contains(e.pkg, embed) {
+			input(start[i] + strings.Count(e.imp, "\n"))
+			b.WriteString(s.freeze("package main\n", e.pkg, ""))
+		}
+	}
+	if run && s.det {
+		fmt.Fprintf(&b, nowFunc, s.now)
+	}
+	if s.hlp {
+		s.writeHelpers(&b, usr)
+	}
+	val := "v"
+	if s.trn && !s.bar {
+		val = "_igoTrunc(v)"
+		fmt.Fprintf(&b, truncFuncs, truncHead, truncTail, truncDepth)
+	}
+	switch {
+	case s.bar:
+	case run && s.col:
+		// The color is reset before the end of the line, so that lines
+		// are counted as they are printed.
+		fmt.Fprintf(&b, printFunc,
+			fmt.Sprintf("\tfmt.Print(%q)\n", resultColor),
+			fmt.Sprintf("\tfmt.Print(%q)\n", resetColor), val)
+	default:
+		fmt.Fprintf(&b, printFunc, "", "", val)
+	}
+	if run {
+		fmt.Fprintf(&b, eofFunc, s.eof, watchedMarker)
+	}
+	if stateful {
+		fmt.Fprintf(&b, stateFuncs, s.sta)
+	}
+	b.WriteString("\n")
+	base(s.top)
+	if ran > 0 {
+		b.Write(s.src[s.top:s.bod])
+		b.WriteString("\n")
+		for _, d := range stateDecls(usr[:ran]) {
+			b.WriteString("var " + d + "\n")
+		}
+		b.WriteString("_igoLoad(" + stateVars(usr[:ran]) + ")\n")
+	} else {
+		b.Write(s.src[s.top:s.off])
+		b.WriteString("\n")
+	}
+	var blocks int
+	for i, e := range usr[ran:] {
+		if e.usr == "" {
+			continue
+		}
+		if e.red != nil {
+			// Earlier declarations are used, since they are shadowed.
+			for _, name := range e.red {
+				b.WriteString("_ = " + name + "\n")
+			}
+			b.WriteString("{\n")
+			blocks++
+		}
+		text := s.freeze("package main\nfunc main() {\n", e.usr, "\n}")
+		if lhs := strings.Join(e.val, ", ") + " := "; e.val != nil {
+			// Columns start at the expression, after its results.
+			if rest, ok := strings.CutPrefix(text, lhs); ok {
+				b.WriteString(lhs)
+				text = rest
+			}
+		}
+		input(start[ran+i] + strings.Count(e.imp+e.pkg, "\n"))
+		b.WriteString(text)
+	}
+	if stateful {
+		b.WriteString("\n_igoSave(" + stateVars(usr) + ")\n")
+	}
+	if blocks > 0 {
+		b.WriteString(strings.Repeat("}\n", blocks))
+	}
+	base(s.off)
+	rest := s.src[s.off:]
+	if s.bar && bytes.HasSuffix(b.Bytes(), []byte("\n")) {
+		// main() does not end with a blank line in programs that are kept.
+		rest = bytes.TrimPrefix(rest, []byte("\n"))
+	}
+	b.Write(rest)
+	// Variables with //go:embed directives follow the rest of the program,
+	// since goimports moves comments that follow the imports.
+	for i, e := range usr {
+		if e.pkg != "" && strings.Contains(e.pkg, embed) {
+			b.WriteString("\n")
+			if run {
+				// Directives must start their lines.
+				line := start[i] + strings.Count(e.imp, "\n")
+				fmt.Fprintf(&b, "//line %s:%d:1\n", in, line)
+			}
+			b.WriteString(s.freeze("package main\n", e.pkg, ""))
+		}
+	}
+	return b.Bytes()
+}
+
+// writeHelpers writes the helpers that the program does not declare to b. If
+// the program is assembled without _igoPrint, only the helpers that entries
+// call are written.
+func (s *Session) writeHelpers(b *bytes.Buffer, usr []entry) {
+	decls := []string{string(s.src)}
+	for _, e := range usr {
+		if e.pkg != "" {
+			decls = append(decls, "package main\n"+e.pkg)
+		}
+	}
+	have := make(map[string]bool)
+	for _, src := range decls {
+		root, err := parser.ParseFile(token.NewFileSet(), "", src,
+			parser.SkipObjectResolution)
+		if err != nil {
+			continue
+		}
+		for _, d := range root.Decls {
+			if fn, ok := d.(*ast.FuncDecl); ok && fn.Recv == nil {
+				have[fn.Name.Name] = true
+			}
+		}
+	}
+	for _, h := range helpers {
+		if have[h.name] {
+			continue
+		}
+		if s.bar && !slices.ContainsFunc(usr, func(e entry) bool {
+			return strings.Contains(e.pkg+e.usr, h.name+"(")
+		}) {
+			continue
+		}
+		b.WriteString(h.code)
+	}
+}
+
+// freeze returns code, which is between prefix and suffix in a program, with
+// time.Now replaced by _igoNow in deterministic mode. The replacement has the
+// same length, so that columns do not move.
+func (s *Session) freeze(prefix, code, suffix string) string {
+	if !s.det || !strings.Contains(code, "time.Now") {
+		return code
+	}
+	root, err := parser.ParseFile(token.NewFileSet(), "",
+		prefix+code+suffix, parser.SkipObjectResolution)
+	if err != nil {
+		return code
+	}
+	buf := []byte(code)
+	ast.Inspect(root, func(n ast.Node) bool {
+		sel, ok := n.(*ast.SelectorExpr)
+		if !ok || sel.Sel.Name != "Now" {
+			return true
+		}
+		if id, ok := sel.X.(*ast.Ident); ok && id.Name == "time" {
+			// Files start at position 1.
+			off := int(sel.Pos()) - 1 - len(prefix)
+			copy(buf[off:], "_igoNow ")
+		}
+		return true
+	})
+	return string(buf)
+}
+
+// linePath returns the path that line directives give to the lines named
+// name, such as input. It is next to the program, where relative names would
+// be next to its overlay instead.
+func (s *Session) linePath(name string) string {
+	pth, _ := filepath.Abs(filepath.Join(filepath.Dir(s.pth), name))
+	return pth
+}
+
+// newLines splits output after the first frm lines, which have already been
+// printed, into the new output of the program and the output that follows the
+// marker. Offsets are in bytes, since the marker and newlines are ASCII.
+func (s *Session) newLines(output string, frm int) (string, string) {
+	start := 0
+	for range frm {
+		i := strings.IndexByte(output[start:], '\n')
+		if i < 0 {
+			start = len(output)
+			break
+		}
+		start += i + 1
+	}
+	eof := s.eof + "\n"
+	end := strings.Index(output, eof)
+	if end < start {
+		// The program exited before printing the marker, so all of the
+		// remaining output is its output.
+		end = len(output)
+	}
+	var rem string
+	if n := end + len(eof); n < len(output) {
+		// The remainder is kept as the program printed it, except that it
+		// ends with a newline, so that the prompt starts on a line of its
+		// own.
+		rem = output[n:]
+		if !strings.HasSuffix(rem, "\n") {
+			rem += "\n"
+		}
+	}
+	return output[start:end], rem
+}
@@ -0,0 +1,416 @@
+package repl
+
+import (
+	"errors"
+	"go/build"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// newSession returns a session without a File that is closed when the test
+// ends.
+func newSession(t *testing.T) *Session {
+	t.Helper()
+	s, err := NewSession(Options{Stdout: io.Discard, Stderr: io.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// eval evaluates each input in s and checks the output of the last one.
+func eval(t *testing.T, s *Session, want string, input ...string) {
+	t.Helper()
+	var out string
+	for _, in := range input {
+		var err error
+		if out, err = s.Eval(in); err != nil {
+			t.Fatalf("Eval(%q): %v", in, err)
+		}
+	}
+	if out != want {
+		t.Errorf("Eval(%q) = %q, want %q", input[len(input)-1], out, want)
+	}
+}
+
+func TestNewLines(t *testing.T) {
+	const eof = "\000igo:eof"
+	tests := []struct {
+		name   string
+		output string
+		frm    int
+		out    string
+		rem    string
+	}{{
+		name:   "empty remainder",
+		output: "a\nb\n" + eof + "\n",
+		frm:    1,
+		out:    "b\n",
+	}, {
+		name:   "remainder",
+		output: "a\n" + eof + "\ndone\n",
+		out:    "a\n",
+		rem:    "done\n",
+	}, {
+		name:   "remainder without trailing newline",
+		output: "a\n" + eof + "\ndone",
+		out:    "a\n",
+		rem:    "done\n",
+	}, {
+		name:   "remainder with blank lines",
+		output: eof + "\n\nx\n\n",
+		rem:    "\nx\n\n",
+	}, {
+		name:   "output without trailing newline",
+		output: "a\nb" + eof + "\n",
+		frm:    1,
+		out:    "b",
+	}, {
+		name:   "no marker",
+		output: "a\nb",
+		frm:    1,
+		out:    "b",
+	}, {
+		name:   "multi-byte output",
+		output: "héllo\n世界\n" + eof + "\n",
+		frm:    1,
+		out:    "世界\n",
+	}, {
+		name:   "multi-byte output before the marker",
+		output: "日本" + eof + "\n",
+		out:    "日本",
+	}, {
+		name:   "multi-byte remainder",
+		output: "é\n" + eof + "\n🙂 bye",
+		out:    "é\n",
+		rem:    "🙂 bye\n",
+	}, {
+		name:   "multi-byte output around the marker",
+		output: "ü" + eof + "\nß\n",
+		out:    "ü",
+		rem:    "ß\n",
+	}, {
+		name:   "all lines printed",
+		output: "a\n" + eof + "\n",
+		frm:    3,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Session{eof: eof}
+			out, rem := s.newLines(tt.output, tt.frm)
+			if out != tt.out || rem != tt.rem {
+				t.Errorf("newLines(%q, %d) = %q, %q, want %q, %q",
+					tt.output, tt.frm, out, rem, tt.out, tt.rem)
+			}
+		})
+	}
+}
+
+func TestIsDecl(t *testing.T) {
+	tests := []struct {
+		input string
+		decl  bool
+		err   error
+	}{
+		{input: "func f() {}", decl: true},
+		{input: "func (t T) M() {}", decl: true},
+		{input: "type T int", decl: true},
+		{input: "const c = 1", decl: true},
+		{input: "const (\n\tA = iota\n\tB\n\tC\n)", decl: true},
+		{input: "const (\n\tA Weekday = iota + 1\n\t_\n\tC\n)", decl: true},
+		{input: "import \"fmt\"", decl: true},
+		{input: "func Map[T, U any](s []T, f func(T) U) []U {\n" +
+			"\tvar r []U\n\tfor _, v := range s {\n\t\tr = append(r, f(v))\n" +
+			"\t}\n\treturn r\n}", decl: true},
+		{input: "type Pair[K comparable, V any] struct {\n\tKey K\n" +
+			"\tVal V\n}", decl: true},
+		{input: "type Number interface {\n\t~int | ~float64\n}", decl: true},
+		{input: "func (p Pair[K, V]) String() string {\n" +
+			"\treturn fmt.Sprint(p.Key)\n}", decl: true},
+		{input: "//go:embed a.txt\nvar a string", decl: true},
+		{input: "var x int"},
+		{input: "var (\n\tx = 1\n\ty = 2\n)"},
+		{input: "x := 1"},
+		{input: "fmt.Println(1)"},
+		{input: "const (\n\tA = iota\n\tB", err: ErrIncomplete},
+		{input: "func f() {", err: ErrIncomplete},
+		{input: "func Map[T, U any](s []T,", err: ErrIncomplete},
+		{input: "type Pair[K comparable, V any] struct {\n\tKey K",
+			err: ErrIncomplete},
+	}
+	for _, tt := range tests {
+		decl, err := isDecl(tt.input)
+		if decl != tt.decl || !errors.Is(err, tt.err) {
+			t.Errorf("isDecl(%q) = %v, %v, want %v, %v",
+				tt.input, decl, err, tt.decl, tt.err)
+		}
+	}
+}
+
+func TestEvalConstBlock(t *testing.T) {
+	s := newSession(t)
+	eval(t, s, "[1 3]\n",
+		"type Weekday int",
+		"const (\n\tSunday Weekday = iota\n\tMonday\n\t_\n\tWednesday\n)",
+		"[]Weekday{Monday, Wednesday}")
+	eval(t, s, "2\n",
+		"func f() int {\n\tconst (\n\t\ta = iota\n\t\tb\n\t\tc\n\t)\n"+
+			"\treturn c\n}",
+		"f()")
+}
+
+func TestIncomplete(t *testing.T) {
+	tests := []struct {
+		input string
+		want  bool
+	}{
+		{"x := 1", false},
+		{"x := 1 +", true},
+		{"f(1,", true},
+		{"switch {", true},
+		{"switch {\ncase x > 0:\n\tfmt.Println(x)", true},
+		{"switch {\ncase x > 0:\n\tfmt.Println(x)\ndefault:\n}", false},
+		{"switch x := y.(type) {\ncase int:\n\tif x > 0 {\n\t}", true},
+		{"select {\ncase v := <-ch:\n\t_ = v", true},
+		{"select {\ncase v := <-ch:\n\t_ = v\ndefault:\n}", false},
+		{"for i := range 3 {", true},
+		{"for i := range 3 {\n\tif i > 1 {\n\t\tbreak\n\t}", true},
+		{"for i := range 3 {\n\tif i > 1 {\n\t\tbreak\n\t}\n}", false},
+		{"if x > 0 {\n\ty = 1\n} else", true},
+		{"if x > 0 {\n\ty = 1\n} else if x < 0 {", true},
+		{"if x > 0 {\n\ty = 1\n} else {\n\ty = 2\n}", false},
+		{"switch {\ncase true:\n\ts := \"{\"", true},
+		{"switch {\ncase true:\n\ts := \"{\"\n}", false},
+		{"switch {\ncase true:\n\ts := \"}\"\n}", false},
+		{"r := '{'", false},
+		{"s := `{`", false},
+		{"s := `{\n{\n`", false},
+		{"s := `{", true},
+		{"f() // {", false},
+		{"f() /* {", true},
+		{"f() /* { */", false},
+		{"//go:embed a.txt", true},
+		{"func Map[T, U any](", true},
+		{"func Map[T,\n\tU any](s []T) {", true},
+		{"func Map[T, U any](s []T, f func(T) U) []U {", true},
+		{"func Map[T, U any](s []T, f func(T) U) []U {\n\treturn nil\n}",
+			false},
+		{"type Pair[K comparable, V any] struct {\n\tKey K\n", true},
+		{"type Pair[K comparable, V any] struct {\n\tKey K\n}", false},
+		{"Map[int, string]([]int{1},", true},
+		{"Map[int, string]([]int{1}, strconv.Itoa)", false},
+		{"x := 1 + \\", true},
+		{"s := \"\\\\\"", false},
+	}
+	for _, tt := range tests {
+		if got := incomplete(tt.input); got != tt.want {
+			t.Errorf("incomplete(%q) = %v, want %v", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestJoinLines(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"x := 1 + \\\n2", "x := 1 +  \n2"},
+		{"x := 1 + \\ \t\n2", "x := 1 +   \t\n2"},
+		{"f(a, \\\n\tb, \\\n\tc)", "f(a,  \n\tb,  \n\tc)"},
+		{"s := \"\\\\\"", "s := \"\\\\\""},
+		{"s := `a\\\nb`", "s := `a\\\nb`"},
+		{"x := 1 // \\\n", "x := 1 // \\\n"},
+		{"x := a \\ b", "x := a \\ b"},
+	}
+	for _, tt := range tests {
+		if got := joinLines(tt.input); got != tt.want {
+			t.Errorf("joinLines(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestEvalBlocks(t *testing.T) {
+	s := newSession(t)
+	eval(t, s, "two {\n",
+		"x := 2",
+		"switch x {\ncase 1:\n\tfmt.Println(\"one }\")\n"+
+			"case 2:\n\tfmt.Println(`two {`)\n}")
+	eval(t, s, "ready\n",
+		"ch := make(chan string, 1)",
+		"ch <- \"ready\"",
+		"select {\ncase v := <-ch:\n\tfmt.Println(v)\ndefault:\n"+
+			"\tfmt.Println(\"none\")\n}")
+	eval(t, s, "-1\n",
+		"y := 0",
+		"if x < 0 {\n\ty = 1\n} else if x > 1 {\n\ty = -1\n} else {\n"+
+			"\ty = 0\n}",
+		"y")
+	eval(t, s, "4\n",
+		"n := 0",
+		"for i := range 5 {\n\tif i%2 == 0 {\n\t\tcontinue\n\t}\n"+
+			"\tn += i\n}",
+		"n")
+}
+
+func TestEvalGenerics(t *testing.T) {
+	s := newSession(t)
+	eval(t, s, "[1 2]\n",
+		"func Map[T, U any](s []T, f func(T) U) []U {\n"+
+			"\tvar r []U\n\tfor _, v := range s {\n\t\tr = append(r, f(v))\n"+
+			"\t}\n\treturn r\n}",
+		"Map([]int{1, 2}, strconv.Itoa)")
+	eval(t, s, "[3]\n", "Map[int, string]([]int{3}, strconv.Itoa)")
+	eval(t, s, "{Key:a Val:1}\n",
+		"type Pair[K comparable, V any] struct {\n\tKey K\n\tVal V\n}",
+		"Pair[string, int]{\"a\", 1}")
+}
+
+func TestGoVersion(t *testing.T) {
+	t.Setenv("GOTOOLCHAIN", "local")
+	if _, err := NewSession(Options{GoVersion: "x"}); err == nil {
+		t.Error("NewSession with go version x: got no error")
+	}
+	s, err := NewSession(Options{GoVersion: "1.21", Stdout: io.Discard,
+		Stderr: io.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	buf, err := os.ReadFile(filepath.Join(s.Dir(), "go.mod"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(buf), "\ngo 1.21\n") {
+		t.Errorf("go.mod does not declare go 1.21:\n%s", buf)
+	}
+	eval(t, s, "2\n", "1 + 1")
+	// Ranging over an int needs go 1.22.
+	if _, err := s.Eval("for range 3 {\n}"); err == nil {
+		t.Error("range over int with go 1.21: got no error")
+	}
+}
+
+func TestRebind(t *testing.T) {
+	s := &Session{val: []string{"_igo3_1", "_igo3_2"}}
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"_", "_igo3_1"},
+		{"_ + _2", "_igo3_1 + _igo3_2"},
+		{"_1 * 2", "_igo3_1 * 2"},
+		{"_3", "_3"},
+		{"_0", "_0"},
+		{"_, err := f(_)", "_, err := f(_igo3_1)"},
+		{"_ = _", "_ = _igo3_1"},
+		{"for _, v := range _ {\n}", "for _, v := range _igo3_1 {\n}"},
+		{"var _ = _2", "var _ = _igo3_2"},
+		{"func(_ int) int { return _ }()",
+			"func(_ int) int { return _igo3_1 }()"},
+		{"x._", "x._"},
+		{"\"_\" + _", "\"_\" + _igo3_1"},
+		{"f(", "f("},
+	}
+	for _, tt := range tests {
+		if got := s.rebind(tt.input); got != tt.want {
+			t.Errorf("rebind(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+	if got := (&Session{}).rebind("_"); got != "_" {
+		t.Errorf("rebind(%q) without results = %q, want %q", "_", got, "_")
+	}
+}
+
+func TestTopVars(t *testing.T) {
+	tests := []struct {
+		input string
+		want  [][]string
+	}{
+		{"x := 1", [][]string{{"x"}}},
+		{"x, y := 1, 2", [][]string{{"x", "y"}}},
+		{"_, err := f()", [][]string{{"err"}}},
+		{"var a, b int", [][]string{{"a"}, {"b"}}},
+		{"var (\n\ta = 1\n\t_ = 2\n)", [][]string{{"a"}}},
+		{"x = 1", nil},
+		{"const c = 1", nil},
+		{"if x := f(); x {\n\ty := 1\n}", nil},
+		{"for i := range 3 {\n}", nil},
+		{"f := func() {\n\tz := 1\n}", [][]string{{"f"}}},
+		{"x := 1\ny, x := 2, 3", [][]string{{"x"}, {"y", "x"}}},
+		{"x :=", nil},
+	}
+	for _, tt := range tests {
+		if got := topVars(tt.input); !slices.EqualFunc(got, tt.want,
+			slices.Equal) {
+			t.Errorf("topVars(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestEvalEmbed(t *testing.T) {
+	s := newSession(t)
+	pth := filepath.Join(s.Dir(), "data.txt")
+	if err := os.WriteFile(pth, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	eval(t, s, "hello\n", "//go:embed data.txt\nvar data string", "data")
+}
+
+func TestGoimportsPlatform(t *testing.T) {
+	pth, err := filepath.Abs("x.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := []byte("package main\n\nfunc main() {\n" +
+		"\twindows.GetCurrentProcessId()\n}\n")
+	const imp = `"golang.org/x/sys/windows"`
+	goos := build.Default.GOOS
+	s := &Session{chk: true, gos: "windows"}
+	buf, err := s.goimports(pth, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(buf), imp) {
+		t.Errorf("goimports for windows did not import %s:\n%s", imp, buf)
+	}
+	if build.Default.GOOS != goos {
+		t.Errorf("build.Default.GOOS = %s, want %s", build.Default.GOOS, goos)
+	}
+	if goos == "windows" {
+		return
+	}
+	s.chk = false
+	if buf, err = s.goimports(pth, src); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(buf), imp) {
+		t.Errorf("goimports for %s imported %s:\n%s", goos, imp, buf)
+	}
+}
+
+func TestEvalWatch(t *testing.T) {
+	s := newSession(t)
+	eval(t, s, "", "q := []int{1}")
+	if _, err := s.Command(".watch len(q)"); err != nil {
+		t.Fatal(err)
+	}
+	eval(t, s, "len(q) = 2\n", "q = append(q, 2)")
+	eval(t, s, "3\nlen(q) = 2\n", "fmt.Println(3)")
+	eval(t, s, "bye\nlen(q) = 2\n", "defer fmt.Println(\"bye\")")
+	if _, err := s.Command(".unwatch 1"); err != nil {
+		t.Fatal(err)
+	}
+	eval(t, s, "", "var m map[string]*int")
+	if _, err := s.Command(".watch *m[\"x\"]"); err != nil {
+		t.Fatal(err)
+	}
+	eval(t, s, "*m[\"x\"] = panic: runtime error: invalid memory address "+
+		"or nil pointer dereference\n", "x := 1")
+	// The watch no longer builds, so the input runs without it.
+	eval(t, s, "", "m := 1")
+}
@@ -0,0 +1,103 @@
+package repl
+
+import (
+	"fmt"
+	"go/types"
+	"slices"
+	"strings"
+)
+
+// stateFuncs are the functions that save and restore the variables of main()
+// in stateful mode. Variables are passed by name and address, and encoded with
+// encoding/gob to the state file at %[1]q. Variables that cannot be encoded
+// are skipped.
+const stateFuncs = `
+func _igoLoad(vars map[string]any) {
+	f, err := os.Open(%[1]q)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	var state map[string][]byte
+	if err := gob.NewDecoder(f).Decode(&state); err != nil {
+		return
+	}
+	for name, v := range vars {
+		if buf, ok := state[name]; ok {
+			_ = gob.NewDecoder(bytes.NewReader(buf)).Decode(v)
+		}
+	}
+}
+
+func _igoSave(vars map[string]any) {
+	state := make(map[string][]byte)
+	for name, v := range vars {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(v); err == nil {
+			state[name] = buf.Bytes()
+		}
+	}
+	f, err := os.Create(%[1]q)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	_ = gob.NewEncoder(f).Encode(state)
+}
+`
+
+// declare sets the variables declared by e, which are the variables of main()
+// that earlier entries do not declare.
+func (s *Session) declare(e *entry) error {
+	c, err := s.check(s.program(*e))
+	if err != nil {
+		return err
+	}
+	have := make(map[string]bool)
+	for _, e := range s.usr {
+		for _, d := range e.dcl {
+			name, _, _ := strings.Cut(d, " ")
+			have[name] = true
+		}
+	}
+	e.dcl = nil
+	for _, v := range c.locals() {
+		if !have[v.Name()] || slices.Contains(e.red, v.Name()) {
+			typ := types.TypeString(v.Type(), c.qualifier)
+			e.dcl = append(e.dcl, v.Name()+" "+typ)
+		}
+	}
+	return nil
+}
+
+// stateDecls returns the variables declared by entries. A variable that is
+// redeclared has the type of its last declaration.
+func stateDecls(entries []entry) []string {
+	var decls []string
+	idx := make(map[string]int)
+	for _, e := range entries {
+		for _, d := range e.dcl {
+			name, _, _ := strings.Cut(d, " ")
+			if i, ok := idx[name]; ok {
+				decls[i] = d
+			} else {
+				idx[name] = len(decls)
+				decls = append(decls, d)
+			}
+		}
+	}
+	return decls
+}
+
+// stateVars returns a map literal of the variables declared by entries, keyed
+// by name.
+func stateVars(entries []entry) string {
+	var b strings.Builder
+	b.WriteString("map[string]any{")
+	for _, d := range stateDecls(entries) {
+		name, _, _ := strings.Cut(d, " ")
+		fmt.Fprintf(&b, "%q: &%s, ", name, name)
+	}
+	b.WriteString("}")
+	return b.String()
+}
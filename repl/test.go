@@ -0,0 +1,131 @@
+package repl
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// test runs the tests that the session declares, or those that match the
+// pattern in arg, with go test, and prints their output as it runs. The tests
+// are moved to a test file next to the program, since go test only runs the
+// tests in test files, with line directives so that failures refer to the
+// lines that were typed. In a temporary module, the file has a unique name and
+// is removed afterwards; next to a File, it is only in the overlay of builds.
+// Tests cannot run in a sandbox, since go test runs them natively.
+func (s *Session) test(arg string) error {
+	if s.wrt != nil {
+		return errors.New("tests cannot run in a sandbox")
+	}
+	var e entry
+	for _, name := range s.unu {
+		e.usr += "_ = " + name + "\n"
+	}
+	src, tests, names, err := splitTests(s.assemble(e, true))
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return errors.New("no tests; declare func TestXxx(t *testing.T)")
+	}
+	pth := filepath.Join(filepath.Dir(s.pth), "igo_test.go")
+	if s.org == nil {
+		f, err := os.CreateTemp(filepath.Dir(s.pth), "igo*_test.go")
+		if err != nil {
+			return fmt.Errorf("failed to create test file: %w", err)
+		}
+		pth = f.Name()
+		defer os.Remove(pth)
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("failed to create test file: %w", err)
+		}
+	}
+	if src, err = s.goimports(s.pth, src); err != nil {
+		return fmt.Errorf("failed to process imports: %w", err)
+	}
+	src = blankImports(src, s.rmi)
+	if tests, err = s.goimports(pth, tests); err != nil {
+		return fmt.Errorf("failed to process imports: %w", err)
+	}
+	err = s.writeFiles(map[string][]byte{s.pth: src, pth: tests})
+	if err != nil {
+		return err
+	}
+	pat := cmp.Or(arg, "^("+strings.Join(names, "|")+")$")
+	args := []string{"test", "-run", pat}
+	if s.rac {
+		args = append(args, "-race")
+	}
+	args = append(args, s.buildFlags()...)
+	cmd := exec.Command("go", append(args, s.pth, pth)...)
+	cmd.Dir, cmd.Env = s.dir, s.environ()
+	cmd.Stdout, cmd.Stderr = s.out, s.err
+	err = s.wait(cmd, 0)
+	if errors.Is(err, ErrInterrupt) {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("tests failed: %w", err)
+	}
+	return nil
+}
+
+// splitTests returns src without its test functions, a file in package main
+// with the test functions, and their names. Test functions that line
+// directives in src move keep their positions.
+func splitTests(src []byte) ([]byte, []byte, []string, error) {
+	fs := token.NewFileSet()
+	root, err := parser.ParseFile(fs, "", src, parser.ParseComments)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to parse: %w", err)
+	}
+	var rest, tests bytes.Buffer
+	tests.WriteString("package main\n")
+	var names []string
+	var off int
+	for _, d := range root.Decls {
+		fn, ok := d.(*ast.FuncDecl)
+		if !ok || fn.Recv != nil || !isTest(fn.Name.Name) {
+			continue
+		}
+		pos := fn.Pos()
+		if fn.Doc != nil {
+			pos = fn.Doc.Pos()
+		}
+		i, j := fs.Position(pos).Offset, fs.Position(fn.End()).Offset
+		rest.Write(src[off:i])
+		tests.WriteString("\n")
+		if p := fs.Position(pos); p.Filename != "" {
+			// Tests keep the positions that line directives give them. The
+			// directive has its own line, where goimports would move it.
+			fmt.Fprintf(&tests, "//line %s:%d:%d\n",
+				p.Filename, p.Line, p.Column)
+		}
+		tests.Write(src[i:j])
+		tests.WriteString("\n")
+		off = j
+		names = append(names, fn.Name.Name)
+	}
+	rest.Write(src[off:])
+	return rest.Bytes(), tests.Bytes(), names, nil
+}
+
+// isTest reports whether name is the name of a test function, which is Test
+// followed by anything that does not start with a lowercase letter.
+func isTest(name string) bool {
+	rest, ok := strings.CutPrefix(name, "Test")
+	if !ok {
+		return false
+	}
+	r, _ := utf8.DecodeRuneInString(rest)
+	return rest == "" || !unicode.IsLower(r)
+}
@@ -0,0 +1,106 @@
+package repl
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSplitTests(t *testing.T) {
+	tests := []struct {
+		name  string
+		src   string
+		rest  string
+		tests string
+		names []string
+	}{{
+		name:  "no tests",
+		src:   "package main\n\nfunc main() {}\n",
+		rest:  "package main\n\nfunc main() {}\n",
+		tests: "package main\n",
+	}, {
+		name: "test",
+		src: "package main\n\nfunc TestA(t *testing.T) {}\n\n" +
+			"func main() {}\n",
+		rest:  "package main\n\n\n\nfunc main() {}\n",
+		tests: "package main\n\nfunc TestA(t *testing.T) {}\n",
+		names: []string{"TestA"},
+	}, {
+		name: "doc comment",
+		src: "package main\n\n// TestB tests b.\nfunc TestB(t *testing.T) {\n" +
+			"\tt.Log(1)\n}\n",
+		rest: "package main\n\n\n",
+		tests: "package main\n\n// TestB tests b.\n" +
+			"func TestB(t *testing.T) {\n\tt.Log(1)\n}\n",
+		names: []string{"TestB"},
+	}, {
+		name: "tests and other functions",
+		src: "package main\n\nfunc Test(t *testing.T) {}\n" +
+			"func Testing() {}\nfunc (T) TestM() {}\n" +
+			"func Test_x(t *testing.T) {}\n",
+		rest: "package main\n\n\nfunc Testing() {}\nfunc (T) TestM() {}\n\n",
+		tests: "package main\n\nfunc Test(t *testing.T) {}\n\n" +
+			"func Test_x(t *testing.T) {}\n",
+		names: []string{"Test", "Test_x"},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rest, tests, names, err := splitTests([]byte(tt.src))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(rest) != tt.rest {
+				t.Errorf("rest = %q, want %q", rest, tt.rest)
+			}
+			if string(tests) != tt.tests {
+				t.Errorf("tests = %q, want %q", tests, tt.tests)
+			}
+			if !slices.Equal(names, tt.names) {
+				t.Errorf("names = %q, want %q", names, tt.names)
+			}
+		})
+	}
+	if _, _, _, err := splitTests([]byte("package main\nfunc {")); err == nil {
+		t.Error("splitTests of invalid source: got no error")
+	}
+}
+
+func TestIsTest(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"Test", true},
+		{"TestA", true},
+		{"Test_a", true},
+		{"Test1", true},
+		{"TestÄ", true},
+		{"Testing", false},
+		{"Testé", false},
+		{"test", false},
+		{"ATest", false},
+	}
+	for _, tt := range tests {
+		if got := isTest(tt.name); got != tt.want {
+			t.Errorf("isTest(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTestLines(t *testing.T) {
+	var out bytes.Buffer
+	s, err := NewSession(Options{Stdout: &out, Stderr: &out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	eval(t, s, "", "x := 1")
+	eval(t, s, "", "func TestA(t *testing.T) {\n\tt.Error(\"nope\")\n}")
+	if err := s.test(""); err == nil {
+		t.Fatal("test: got no error")
+	}
+	if want := "input:3: nope"; !strings.Contains(out.String(), want) {
+		t.Errorf("output does not contain %q:\n%s", want, out.String())
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"lesiw.io/igo/repl"
+)
+
+// idleTimeout is how long a connection can be idle before it is closed.
+const idleTimeout = 30 * time.Minute
+
+// serve accepts connections on addr, which is on localhost if it has no host,
+// and runs a session with opts for each of them. If imp is not empty, it is
+// evaluated first in each session.
+func serve(addr string, opts repl.Options, imp string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("bad address %q: %w", addr, err)
+	}
+	if host == "" {
+		addr = net.JoinHostPort("localhost", port)
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	defer ln.Close()
+	fmt.Fprintln(stderr, "listening on", ln.Addr())
+	var input []byte
+	if opts.Stdin != nil {
+		// Each session reads the input from the start.
+		if input, err = io.ReadAll(opts.Stdin); err != nil {
+			return fmt.Errorf("failed to read stdin: %w", err)
+		}
+	}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return fmt.Errorf("failed to accept connection: %w", err)
+		}
+		go func() {
+			defer conn.Close()
+			opts := opts
+			if input != nil {
+				opts.Stdin = bytes.NewReader(input)
+			}
+			if err := serveConn(conn, opts, imp); err != nil {
+				printError(fmt.Errorf("%s: %w", conn.RemoteAddr(), err))
+			}
+		}()
+	}
+}
+
+// serveConn runs a session with opts that reads input from conn and writes
+// output to it, until the end of input, .quit, or the connection is idle for
+// idleTimeout. Clients are not authenticated, so the session cannot run shell
+// commands or access files of the host, other than through programs.
+func serveConn(conn net.Conn, opts repl.Options, imp string) error {
+	opts.Stdout, opts.Stderr = conn, conn
+	opts.NoShell, opts.NoFiles = true, true
+	s, err := repl.NewSession(opts)
+	if err != nil {
+		fmt.Fprintln(conn, err)
+		return err
+	}
+	defer s.Close()
+	if imp != "" {
+		if _, err := s.Eval(imp); err != nil {
+			fmt.Fprintln(conn, err)
+		}
+	}
+	rd := bufio.NewReader(conn)
+	prompt := "> "
+	var line string // Input of an incomplete entry.
+	for {
+		fmt.Fprint(conn, prompt)
+		_ = conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		input, err := rd.ReadString('\n')
+		if ne := net.Error(nil); errors.As(err, &ne) && ne.Timeout() {
+			fmt.Fprintln(conn, "\nclosing idle connection")
+			return nil
+		} else if errors.Is(err, io.EOF) && input == "" {
+			return nil
+		} else if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("failed to read input: %w", err)
+		}
+		input = strings.TrimRight(input, "\r\n")
+		prompt = "... "
+		if line != "" {
+			line += "\n" + input
+		} else if input = strings.TrimSpace(input); input == ".quit" ||
+			input == ".exit" {
+			return nil
+		} else if ok, err := s.Command(input); ok {
+			if err != nil {
+				fmt.Fprintln(conn, err)
+			}
+			prompt = "> "
+			continue
+		} else {
+			line = input
+		}
+		out, err := s.Eval(line)
+		fmt.Fprint(conn, out)
+		if errors.Is(err, repl.ErrIncomplete) {
+			continue
+		} else if err != nil {
+			fmt.Fprintln(conn, err)
+		}
+		line, prompt = "", "> "
+	}
+}
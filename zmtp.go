@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// Flags of ZMTP frames.
+const (
+	flagMore    = 1 << 0 // More frames of the message follow.
+	flagLong    = 1 << 1 // The size of the frame is 8 bytes rather than 1.
+	flagCommand = 1 << 2 // The frame is a command rather than a message.
+)
+
+// maxFrame is the size of the largest frame that is read.
+const maxFrame = 1 << 30
+
+// A zsocket is a socket of ZMTP 3.0, the protocol of ZeroMQ, with the NULL
+// security mechanism. It implements as much of ZeroMQ as a Jupyter kernel
+// needs: it binds to an address and calls handle, if it is not nil, with each
+// message from a peer, which it can reply to on the peer's connection.
+type zsocket struct {
+	typ    string // Socket type, e.g. ROUTER.
+	ln     net.Listener
+	handle func(c *zconn, msg [][]byte)
+	mu     sync.Mutex
+	cns    map[*zconn]bool // Connected peers.
+}
+
+// A zconn is a connection to the peer of a zsocket.
+type zconn struct {
+	conn net.Conn
+	mu   sync.Mutex // Guards writes.
+}
+
+// listenZMQ returns a zsocket of type typ that listens on addr.
+func listenZMQ(addr, typ string,
+	handle func(c *zconn, msg [][]byte)) (*zsocket, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+	z := &zsocket{typ: typ, ln: ln, handle: handle,
+		cns: make(map[*zconn]bool)}
+	go z.accept()
+	return z, nil
+}
+
+// Close stops listening for peers.
+func (z *zsocket) Close() error {
+	return z.ln.Close()
+}
+
+func (z *zsocket) accept() {
+	for {
+		conn, err := z.ln.Accept()
+		if err != nil {
+			return
+		}
+		go z.serve(&zconn{conn: conn})
+	}
+}
+
+// serve reads messages from c until it is closed.
+func (z *zsocket) serve(c *zconn) {
+	defer c.conn.Close()
+	if err := c.handshake(z.typ); err != nil {
+		return
+	}
+	z.mu.Lock()
+	z.cns[c] = true
+	z.mu.Unlock()
+	defer func() {
+		z.mu.Lock()
+		delete(z.cns, c)
+		z.mu.Unlock()
+	}()
+	for {
+		msg, err := c.recv()
+		if err != nil {
+			return
+		}
+		if z.handle != nil {
+			z.handle(c, msg)
+		}
+	}
+}
+
+// broadcast sends msg to every peer, as a PUB socket does. Subscriptions are
+// not filtered.
+func (z *zsocket) broadcast(msg [][]byte) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	for c := range z.cns {
+		_ = c.send(msg)
+	}
+}
+
+// handshake exchanges greetings and READY commands with the peer.
+func (c *zconn) handshake(typ string) error {
+	greeting := make([]byte, 64)
+	greeting[0], greeting[9] = 0xff, 0x7f
+	greeting[10] = 3 // Version 3.0.
+	copy(greeting[12:], "NULL")
+	if _, err := c.conn.Write(greeting); err != nil {
+		return err
+	}
+	peer := make([]byte, 64)
+	if _, err := io.ReadFull(c.conn, peer); err != nil {
+		return err
+	}
+	if peer[0] != 0xff || peer[9]&1 != 1 || peer[10] < 3 {
+		return errors.New("bad greeting")
+	}
+	mech := string(bytes.TrimRight(peer[12:32], "\x00"))
+	if mech != "NULL" {
+		return fmt.Errorf("unsupported mechanism %q", mech)
+	}
+	ready := []byte("\x05READY\x0bSocket-Type")
+	ready = binary.BigEndian.AppendUint32(ready, uint32(len(typ)))
+	ready = append(ready, typ...)
+	c.mu.Lock()
+	_, err := c.conn.Write(appendFrame(nil, flagCommand, ready))
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	flags, _, err := c.frame()
+	if err != nil {
+		return err
+	} else if flags&flagCommand == 0 {
+		return errors.New("expected READY command")
+	}
+	return nil
+}
+
+// frame reads a frame.
+func (c *zconn) frame() (flags byte, body []byte, err error) {
+	var hdr [9]byte
+	if _, err := io.ReadFull(c.conn, hdr[:2]); err != nil {
+		return 0, nil, err
+	}
+	flags, size := hdr[0], uint64(hdr[1])
+	if flags&flagLong != 0 {
+		if _, err := io.ReadFull(c.conn, hdr[2:]); err != nil {
+			return 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(hdr[1:])
+	}
+	if size > maxFrame {
+		return 0, nil, fmt.Errorf("frame of %d bytes is too large", size)
+	}
+	body = make([]byte, size)
+	if _, err := io.ReadFull(c.conn, body); err != nil {
+		return 0, nil, err
+	}
+	return flags, body, nil
+}
+
+// recv reads a message, skipping commands.
+func (c *zconn) recv() ([][]byte, error) {
+	var msg [][]byte
+	for {
+		flags, body, err := c.frame()
+		if err != nil {
+			return nil, err
+		}
+		if flags&flagCommand != 0 {
+			continue
+		}
+		msg = append(msg, body)
+		if flags&flagMore == 0 {
+			return msg, nil
+		}
+	}
+}
+
+// send writes msg.
+func (c *zconn) send(msg [][]byte) error {
+	var b []byte
+	for i, f := range msg {
+		var flags byte
+		if i < len(msg)-1 {
+			flags = flagMore
+		}
+		b = appendFrame(b, flags, f)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.conn.Write(b)
+	return err
+}
+
+// appendFrame appends a frame with flags and body to b.
+func appendFrame(b []byte, flags byte, body []byte) []byte {
+	if len(body) > 255 {
+		b = append(b, flags|flagLong)
+		b = binary.BigEndian.AppendUint64(b, uint64(len(body)))
+	} else {
+		b = append(b, flags, byte(len(body)))
+	}
+	return append(b, body...)
+}